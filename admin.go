@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/piknik/server"
+)
+
+const maxAdminCommandLen = 256
+
+type adminCommand struct {
+	help    string
+	handler func(conf Conf, srv *server.Server, out *bytes.Buffer) error
+}
+
+var adminCommands = map[string]adminCommand{
+	"status":  {"show whether the clipboard is empty, its size and age", adminStatus},
+	"clear":   {"clear the clipboard content", adminClear},
+	"clients": {"list connected clients", adminClients},
+	"pullers": {"list clients receiving or waiting to receive a stream, and how far behind they are", adminPullers},
+	"abort":   {"abort all active stream pushes", adminAbort},
+	"config":  {"show the effective server configuration", adminConfig},
+}
+
+func adminStatus(conf Conf, srv *server.Server, out *bytes.Buffer) error {
+	fmt.Fprintf(out, "%v\n", clipboardStatus(srv))
+	return nil
+}
+
+func adminClear(conf Conf, srv *server.Server, out *bytes.Buffer) error {
+	cleared, err := srv.Clear()
+	if err != nil {
+		return err
+	}
+	if !cleared {
+		fmt.Fprintf(out, "the clipboard was already empty\n")
+	} else {
+		fmt.Fprintf(out, "the clipboard has been cleared\n")
+	}
+	return nil
+}
+
+func adminClients(conf Conf, srv *server.Server, out *bytes.Buffer) error {
+	for _, client := range srv.Clients() {
+		opcode := "-"
+		if client.Opcode != 0 {
+			opcode = string(client.Opcode)
+		}
+		fmt.Fprintf(out, "%v\t%v\tv%v\t%v\t%v\n", client.ID, client.RemoteAddr, client.Version, opcode,
+			time.Since(client.Since).Truncate(time.Second))
+	}
+	return nil
+}
+
+func adminPullers(conf Conf, srv *server.Server, out *bytes.Buffer) error {
+	for _, p := range srv.Pullers() {
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\tdelivered=%v\tlag=%v\tspilled=%v\n", p.ID, p.Channel, p.RemoteAddr,
+			time.Since(p.Since).Truncate(time.Second), p.Delivered, p.Queued, p.Spilled)
+	}
+	return nil
+}
+
+func adminAbort(conf Conf, srv *server.Server, out *bytes.Buffer) error {
+	pushes := srv.AbortPushes()
+	if len(pushes) == 0 {
+		return fmt.Errorf("no push is active")
+	}
+	for _, push := range pushes {
+		fmt.Fprintf(out, "the push from %v on channel %v has been aborted\n", push.RemoteAddr, push.Channel)
+	}
+	return nil
+}
+
+func adminConfig(conf Conf, srv *server.Server, out *bytes.Buffer) error {
+	fmt.Fprintf(out, "Listen            = %q\n", conf.Listen)
+	fmt.Fprintf(out, "AdminSocket       = %q\n", conf.AdminSocket)
+	fmt.Fprintf(out, "HealthListen      = %q\n", conf.HealthListen)
+	fmt.Fprintf(out, "SignPk            = %q\n", hex.EncodeToString(conf.SignPk))
+	fmt.Fprintf(out, "MaxClients        = %v\n", conf.MaxClients)
+	fmt.Fprintf(out, "MaxWatchers       = %v\n", conf.MaxWatchers)
+	fmt.Fprintf(out, "TrustedIPCount    = %v\n", conf.TrustedIPCount)
+	fmt.Fprintf(out, "MaxLen            = %v\n", conf.MaxLen)
+	fmt.Fprintf(out, "Timeout           = %v\n", conf.Timeout)
+	fmt.Fprintf(out, "DataTimeout       = %v\n", conf.DataTimeout)
+	fmt.Fprintf(out, "TTL               = %v\n", conf.TTL)
+	fmt.Fprintf(out, "MaxStreamBytes    = %v\n", conf.MaxStreamBytes)
+	fmt.Fprintf(out, "MaxStreamDuration = %v\n", conf.MaxStreamDuration)
+	fmt.Fprintf(out, "MaxWaitingPullers = %v\n", conf.MaxWaitingPullers)
+	fmt.Fprintf(out, "MaxReplayBytes    = %v\n", conf.MaxReplayBytes)
+	fmt.Fprintf(out, "MaxReplayMemory   = %v\n", conf.MaxReplayMemory)
+	fmt.Fprintf(out, "SpoolDir          = %q\n", conf.SpoolDir)
+	fmt.Fprintf(out, "SpoolRetention    = %v\n", conf.SpoolRetention)
+	fmt.Fprintf(out, "MaxSpoolBytes     = %v\n", conf.MaxSpoolBytes)
+	fmt.Fprintf(out, "SlowPullerPolicy  = %q\n", conf.SlowPullerPolicy)
+	fmt.Fprintf(out, "MaxSpillBytes     = %v\n", conf.MaxSpillBytes)
+	fmt.Fprintf(out, "MaxSpillTotal     = %v\n", conf.MaxSpillTotal)
+	fmt.Fprintf(out, "MaxRate           = %v\n", conf.MaxRate)
+	fmt.Fprintf(out, "MaxConnectionRate = %v\n", conf.MaxConnectionRate)
+	fmt.Fprintf(out, "ClipboardFile     = %q\n", conf.ClipboardFile)
+	return nil
+}
+
+func handleAdminConnection(conf Conf, srv *server.Server, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(conf.Timeout))
+	line, err := bufio.NewReader(io.LimitReader(conn, maxAdminCommandLen)).ReadString('\n')
+	if err != nil {
+		return
+	}
+	name := strings.TrimSpace(line)
+	var out bytes.Buffer
+	command, ok := adminCommands[name]
+	if !ok {
+		err = fmt.Errorf("unknown command %q", name)
+	} else {
+		err = command.handler(conf, srv, &out)
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "OK\n")
+	conn.Write(out.Bytes())
+}
+
+func runAdminServer(conf Conf, srv *server.Server) {
+	if fi, err := os.Lstat(conf.AdminSocket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			log.Fatalf("Admin socket path [%v] exists and is not a socket", conf.AdminSocket)
+		}
+		os.Remove(conf.AdminSocket)
+	}
+	listen, err := listenAdminSocket(conf.AdminSocket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listen.Close()
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go handleAdminConnection(conf, srv, conn)
+	}
+}
+
+// listenAdminSocket - Creates the socket in a private directory, and only
+// moves it to its final path once only the owner can connect to it
+func listenAdminSocket(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".piknik-admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	listen, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listen.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listen.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return listen, nil
+}
+
+func adminUsage() string {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var usage strings.Builder
+	usage.WriteString("Available admin commands:\n")
+	for _, name := range names {
+		fmt.Fprintf(&usage, "  %-8s %v\n", name, adminCommands[name].help)
+	}
+	return usage.String()
+}
+
+func RunAdmin(conf Conf, command string) {
+	if _, ok := adminCommands[command]; !ok {
+		log.Fatalf("Unknown admin command [%v]\n%v", command, adminUsage())
+	}
+	conn, err := net.DialTimeout("unix", conf.AdminSocket, conf.Timeout)
+	if err != nil {
+		log.Fatalf("Unable to connect to the admin socket [%v] - Is a Piknik server running on this host?",
+			conf.AdminSocket)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(conf.Timeout))
+	fmt.Fprintf(conn, "%v\n", command)
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		log.Fatal(err)
+	}
+	if msg, isErr := strings.CutPrefix(strings.TrimSpace(status), "ERR "); isErr {
+		log.Fatalf("Admin command failed: %v", msg)
+	}
+	if _, err := io.Copy(os.Stdout, reader); err != nil {
+		log.Fatal(err)
+	}
+}
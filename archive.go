@@ -0,0 +1,365 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/blake2b-simd"
+)
+
+// Files and directories are transferred as a tar archive. Each regular file
+// carries a BLAKE2b hash of its content in a PAX record, that the receiver
+// verifies before accepting the file.
+
+const (
+	ArchiveMIMEType   = "application/x-tar"
+	archiveHashRecord = "PIKNIK.blake2b"
+)
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hf := blake2b.New256()
+	if _, err := io.Copy(hf, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hf.Sum(nil)), nil
+}
+
+func archiveFile(tw *tar.Writer, filePath string, name string, fi fs.FileInfo) error {
+	hash, err := hashFile(filePath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Mode:       int64(fi.Mode().Perm()),
+		Size:       fi.Size(),
+		ModTime:    fi.ModTime(),
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{archiveHashRecord: hash},
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, file, fi.Size()); err != nil {
+		return fmt.Errorf("[%v] changed while being archived: %v", filePath, err)
+	}
+	return nil
+}
+
+func writeArchive(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	for _, root := range paths {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(absRoot)
+		if base == string(filepath.Separator) {
+			return fmt.Errorf("Refusing to archive the root directory")
+		}
+		err = filepath.WalkDir(absRoot, func(filePath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(absRoot, filePath)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(rel))
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			switch {
+			case fi.Mode().IsRegular():
+				return archiveFile(tw, filePath, name, fi)
+			case fi.IsDir():
+				return tw.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     name + "/",
+					Mode:     int64(fi.Mode().Perm()),
+					ModTime:  fi.ModTime(),
+					Format:   tar.FormatPAX,
+				})
+			default:
+				log.Printf("Skipping [%v]: not a regular file or directory", filePath)
+				return nil
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func rootMkdirAll(root *os.Root, name string) error {
+	current := ""
+	for _, component := range strings.Split(name, "/") {
+		current = path.Join(current, component)
+		if err := root.Mkdir(current, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		if fi, err := root.Lstat(current); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("[%v] exists and is not a directory", current)
+		}
+	}
+	return nil
+}
+
+func extractFile(root *os.Root, hdr *tar.Header, tr *tar.Reader) error {
+	name := hdr.Name
+	expectedHash, ok := hdr.PAXRecords[archiveHashRecord]
+	if !ok {
+		return fmt.Errorf("No hash for [%v]", name)
+	}
+	if dir := path.Dir(name); dir != "." {
+		if err := rootMkdirAll(root, dir); err != nil {
+			return err
+		}
+	}
+	file, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	hf := blake2b.New256()
+	_, err = io.Copy(io.MultiWriter(file, hf), tr)
+	if err == nil {
+		err = file.Chmod(fs.FileMode(hdr.Mode).Perm())
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(hf.Sum(nil)) != expectedHash {
+		err = fmt.Errorf("Hash mismatch for [%v]", name)
+	}
+	if err != nil {
+		root.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// extractArchive - Extracts an archive into dir, refusing entries that would
+// be written outside of it
+func extractArchive(r io.Reader, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer root.Close()
+
+	type dirTimes struct {
+		name    string
+		mode    fs.FileMode
+		modTime time.Time
+	}
+	var dirs []dirTimes
+	count := 0
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		name := path.Clean(hdr.Name)
+		if !filepath.IsLocal(filepath.FromSlash(name)) || strings.Contains(hdr.Name, `\`) {
+			return count, fmt.Errorf("Refusing to extract [%v]: path outside of the destination directory", hdr.Name)
+		}
+		hdr.Name = name
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if err := extractFile(root, hdr, tr); err != nil {
+				return count, err
+			}
+			setAttributes(filepath.Join(dir, filepath.FromSlash(name)), 0, hdr.ModTime)
+			count++
+		case tar.TypeDir:
+			if err := rootMkdirAll(root, name); err != nil {
+				return count, err
+			}
+			dirs = append(dirs, dirTimes{name: name, mode: fs.FileMode(hdr.Mode).Perm(), modTime: hdr.ModTime})
+		default:
+			log.Printf("Skipping [%v]: unsupported file type", hdr.Name)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i].name) > len(dirs[j].name) })
+	for _, d := range dirs {
+		setAttributes(filepath.Join(dir, filepath.FromSlash(d.name)), d.mode, d.modTime)
+	}
+	return count, nil
+}
+
+// setAttributes - Sets the permissions (unless mode is 0) and the
+// modification time of an extracted entry. Symbolic links are skipped, since
+// these would be followed, possibly outside of the destination directory.
+func setAttributes(filePath string, mode fs.FileMode, modTime time.Time) {
+	if fi, err := os.Lstat(filePath); err != nil || fi.Mode()&fs.ModeSymlink != 0 {
+		return
+	}
+	if mode != 0 {
+		os.Chmod(filePath, mode)
+	}
+	os.Chtimes(filePath, modTime, modTime)
+}
+
+// moveExtracted - Moves the entries of the name directory of srcDir to the
+// same directory of root, whose path is dstDir. Directories that already
+// exist in the destination are merged.
+func moveExtracted(root *os.Root, dstDir string, srcDir string, name string) error {
+	entries, err := os.ReadDir(filepath.Join(srcDir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryName := path.Join(name, entry.Name())
+		src := filepath.Join(srcDir, filepath.FromSlash(entryName))
+		dst := filepath.Join(dstDir, filepath.FromSlash(entryName))
+		srcInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		dstInfo, err := root.Lstat(entryName)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) || (err == nil && !srcInfo.IsDir() && dstInfo.Mode().IsRegular()):
+			if err := os.Rename(src, dst); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case srcInfo.IsDir() && dstInfo.IsDir():
+			if err := moveExtracted(root, dstDir, srcDir, entryName); err != nil {
+				return err
+			}
+			setAttributes(dst, srcInfo.Mode().Perm(), srcInfo.ModTime())
+		case srcInfo.IsDir():
+			return fmt.Errorf("[%v] exists and is not a directory", dst)
+		default:
+			return fmt.Errorf("[%v] exists and is not a regular file", dst)
+		}
+	}
+	return nil
+}
+
+// With -paste-to, the archive is extracted into a temporary directory within
+// the destination. Its files are only moved to the destination once the
+// content has been entirely received and verified, and the temporary
+// directory is deleted if anything fails.
+
+// extraction - Archive being extracted, written like any other output
+type extraction struct {
+	*io.PipeWriter
+
+	dir         string
+	tmpDir      string
+	count       int
+	done        chan error
+	finished    bool
+	interrupted chan os.Signal
+}
+
+func startExtraction(dir string) (*extraction, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp(dir, ".piknik-*")
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	ex := &extraction{
+		PipeWriter:  pw,
+		dir:         dir,
+		tmpDir:      tmpDir,
+		done:        make(chan error, 1),
+		interrupted: make(chan os.Signal, 1),
+	}
+	go func() {
+		count, err := extractArchive(pr, tmpDir)
+		if err == nil {
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		ex.count = count
+		ex.done <- err
+	}()
+	signal.Notify(ex.interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-ex.interrupted; ok {
+			os.RemoveAll(tmpDir)
+			os.Exit(1)
+		}
+	}()
+	return ex, nil
+}
+
+// finish - Waits for the extraction to complete, and deletes the temporary
+// directory once commit has moved the files out of it
+func (ex *extraction) finish(err error, commit func() error) error {
+	if ex.finished {
+		return err
+	}
+	ex.finished = true
+	signal.Stop(ex.interrupted)
+	close(ex.interrupted)
+	ex.CloseWithError(err)
+	if extractErr := <-ex.done; err == nil {
+		err = extractErr
+	}
+	if err == nil && commit != nil {
+		err = commit()
+	}
+	os.RemoveAll(ex.tmpDir)
+	return err
+}
+
+// commit - Moves the extracted files to the destination, and returns their
+// number
+func (ex *extraction) commit() (int, error) {
+	err := ex.finish(nil, func() error {
+		root, err := os.OpenRoot(ex.dir)
+		if err != nil {
+			return err
+		}
+		defer root.Close()
+		return moveExtracted(root, ex.dir, ex.tmpDir, ".")
+	})
+	return ex.count, err
+}
+
+// abort - Stops the extraction, and deletes the extracted files
+func (ex *extraction) abort(err error) {
+	ex.finish(err, nil)
+}
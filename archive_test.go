@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minio/blake2b-simd"
+)
+
+// testArchive - An archive holding a regular file for every name, or a
+// symbolic link for names of the form "name@target"
+func testArchive(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range names {
+		var hdr *tar.Header
+		content := []byte("content of " + name)
+		if name, target, ok := strings.Cut(name, "@"); ok {
+			hdr = &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Format: tar.FormatPAX}
+			content = nil
+		} else {
+			hash := blake2b.Sum256(content)
+			hdr = &tar.Header{
+				Typeflag:   tar.TypeReg,
+				Name:       name,
+				Mode:       0o644,
+				Size:       int64(len(content)),
+				Format:     tar.FormatPAX,
+				PAXRecords: map[string]string{archiveHashRecord: hex.EncodeToString(hash[:])},
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// assertEmpty - Fails if anything was written to dir
+func assertEmpty(t *testing.T, dir string) {
+	t.Helper()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("%v entries were written to [%v]", len(entries), dir)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "file"), []byte("content"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := writeArchive(&archive, []string{src}); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if count, err := extractArchive(&archive, dst); count != 1 || err != nil {
+		t.Fatalf("extractArchive() = %v, %v", count, err)
+	}
+	extracted := filepath.Join(dst, "src", "sub", "file")
+	if content, err := os.ReadFile(extracted); err != nil || string(content) != "content" {
+		t.Fatalf("extracted %q (%v)", content, err)
+	}
+	if fi, err := os.Stat(extracted); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Fatalf("extracted file mode = %v (%v), want 0640", fi.Mode().Perm(), err)
+	}
+}
+
+func TestExtractArchiveRefusesTraversal(t *testing.T) {
+	for _, name := range []string{"../escaped", "dir/../../escaped", "/tmp/escaped", `..\escaped`} {
+		parent := t.TempDir()
+		dst := filepath.Join(parent, "dst")
+		if _, err := extractArchive(bytes.NewReader(testArchive(t, name)), dst); err == nil {
+			t.Errorf("extractArchive() of [%v] should have failed", name)
+		}
+		assertEmpty(t, dst)
+		if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+			t.Errorf("[%v] was written outside of the destination", name)
+		}
+	}
+}
+
+func TestExtractArchiveSkipsSymlinks(t *testing.T) {
+	outside, dst := t.TempDir(), t.TempDir()
+	archive := testArchive(t, "link@"+outside, "link/file")
+	if _, err := extractArchive(bytes.NewReader(archive), dst); err != nil {
+		t.Fatal(err)
+	}
+	assertEmpty(t, outside)
+	if fi, err := os.Lstat(filepath.Join(dst, "link")); err != nil || !fi.IsDir() {
+		t.Fatalf("[link] should have been created as a directory (%v)", err)
+	}
+}
+
+func TestExtractArchiveDoesntFollowSymlinks(t *testing.T) {
+	outside, dst := t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dst, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractArchive(bytes.NewReader(testArchive(t, "link/file")), dst); err == nil {
+		t.Fatal("extractArchive() through a symbolic link should have failed")
+	}
+	assertEmpty(t, outside)
+}
+
+func TestMoveExtractedRefusesToOverwrite(t *testing.T) {
+	outside := t.TempDir()
+	tests := []struct {
+		name     string
+		existing func(dst string) error
+		archive  []string
+	}{
+		{"symbolic link replaced by a directory", func(dst string) error {
+			return os.Symlink(outside, filepath.Join(dst, "entry"))
+		}, []string{"entry/file"}},
+		{"symbolic link replaced by a file", func(dst string) error {
+			return os.Symlink(filepath.Join(outside, "file"), filepath.Join(dst, "entry"))
+		}, []string{"entry"}},
+		{"directory replaced by a file", func(dst string) error {
+			return os.Mkdir(filepath.Join(dst, "entry"), 0o755)
+		}, []string{"entry"}},
+		{"file replaced by a directory", func(dst string) error {
+			return os.WriteFile(filepath.Join(dst, "entry"), nil, 0o644)
+		}, []string{"entry/file"}},
+	}
+	for _, test := range tests {
+		dst := t.TempDir()
+		if err := test.existing(dst); err != nil {
+			t.Fatal(err)
+		}
+		ex, err := startExtraction(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.Write(testArchive(t, test.archive...))
+		if _, err := ex.commit(); err == nil {
+			t.Errorf("%v: commit() should have failed", test.name)
+		}
+		assertEmpty(t, outside)
+		if entries, _ := os.ReadDir(dst); len(entries) != 1 {
+			t.Errorf("%v: the temporary directory wasn't removed", test.name)
+		}
+	}
+}
@@ -1,490 +1,322 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/rand"
-	"crypto/subtle"
-	"encoding/binary"
+	"context"
+	"fmt"
 	"io"
 	"log"
-	"math"
-	"net"
 	"os"
+	"os/exec"
+	"runtime"
 	"syscall"
 	"time"
 
-	"golang.org/x/crypto/chacha20"
-	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/ed25519"
+	"github.com/jedisct1/piknik/client"
 )
 
-const DefaultClientVersion = byte(7)
-
-// Client - Client data
-type Client struct {
-	conf    Conf
-	conn    net.Conn
-	reader  *bufio.Reader
-	writer  *bufio.Writer
-	version byte
+// ClientOptions - Operation and per-invocation settings of a client
+type ClientOptions struct {
+	IsCopy      bool
+	IsMove      bool
+	IsPush      bool
+	IsPull      bool
+	IsInfo      bool
+	IsStatus    bool
+	IsClear     bool
+	IsWatch     bool
+	Exec        string
+	Wait        time.Duration
+	WaitPullers uint32
+	WaitTimeout time.Duration
+	Replay      time.Duration
+	Store       bool
+	Ack         bool
+	Retries     uint
+	CID         string
+	Name        string
+	MIMEType    string
+	Files       []string
+	PasteTo     string
+	Output      string
+	Stats       bool
 }
 
-func (client *Client) copyOperation(h1 []byte) {
-	ts := make([]byte, 8)
-	binary.LittleEndian.PutUint64(ts, uint64(time.Now().Unix()))
-
-	conf, reader, writer := client.conf, client.reader, client.writer
-
-	var contentWithEncryptSkIDAndNonceBuf bytes.Buffer
-	contentWithEncryptSkIDAndNonceBuf.Grow(8 + 24 + bytes.MinRead)
-
-	contentWithEncryptSkIDAndNonceBuf.Write(conf.EncryptSkID)
-
-	nonce := make([]byte, 24)
-	if _, err := rand.Read(nonce); err != nil {
-		log.Fatal(err)
+// clientConfig - Settings of the client library
+func (conf Conf) clientConfig() client.Config {
+	return client.Config{
+		Connect:             conf.Connect,
+		Psk:                 conf.Psk,
+		SignPk:              conf.SignPk,
+		SignSk:              conf.SignSk,
+		EncryptSk:           conf.EncryptSk,
+		EncryptSkID:         conf.EncryptSkID,
+		Timeout:             conf.Timeout,
+		DataTimeout:         conf.DataTimeout,
+		TTL:                 conf.TTL,
+		MaxStreamBytes:      conf.MaxStreamBytes,
+		MaxStreamDuration:   conf.MaxStreamDuration,
+		Compression:         conf.Compression,
+		MaxDecompressedSize: conf.MaxDecompressedSize,
+		LimitRate:           conf.LimitRate,
+		ErrorLog:            log.Default(),
 	}
-	contentWithEncryptSkIDAndNonceBuf.Write(nonce)
+}
 
-	_, err := contentWithEncryptSkIDAndNonceBuf.ReadFrom(os.Stdin)
+func newClient(conf Conf) *client.Client {
+	c, err := client.New(conf.clientConfig())
 	if err != nil {
 		log.Fatal(err)
 	}
-	contentWithEncryptSkIDAndNonce := contentWithEncryptSkIDAndNonceBuf.Bytes()
+	return c
+}
 
-	cipher, err := chacha20.NewUnauthenticatedCipher(conf.EncryptSk, nonce)
-	if err != nil {
-		log.Fatal(err)
+func runCommand(command string, stdin io.Reader) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
 	}
-	opcode := byte('S')
-	cipher.XORKeyStream(contentWithEncryptSkIDAndNonce[8+24:], contentWithEncryptSkIDAndNonce[8+24:])
-	signature := ed25519.Sign(conf.SignSk, contentWithEncryptSkIDAndNonce)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
 
-	client.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
-	h2 := auth2store(conf, client.version, h1, opcode, ts, signature)
-	writer.WriteByte(opcode)
-	writer.Write(h2)
-	ciphertextWithEncryptSkIDAndNonceLen := uint64(len(contentWithEncryptSkIDAndNonce))
-	binary.Write(writer, binary.LittleEndian, ciphertextWithEncryptSkIDAndNonceLen)
-	writer.Write(ts)
-	writer.Write(signature)
-	writer.Write(contentWithEncryptSkIDAndNonce)
-	if err = writer.Flush(); err != nil {
-		log.Fatal(err)
-	}
-	rbuf := make([]byte, 32)
-	if _, err = io.ReadFull(reader, rbuf); err != nil {
-		if err == io.ErrUnexpectedEOF {
-			log.Fatal("The server may be running an incompatible version")
-		} else {
-			log.Fatal(err)
-		}
-	}
-	h3 := rbuf
-	wh3 := auth3store(conf, h2)
-	if subtle.ConstantTimeCompare(wh3, h3) != 1 {
-		log.Fatal("Incorrect authentication code")
-	}
-	if IsTerminal(int(syscall.Stderr)) {
-		os.Stderr.WriteString("Sent\n")
+// writeItem - Writes clipboard content, or prints its metadata in info mode
+func writeItem(w io.Writer, item *client.Item, isInfo bool) error {
+	if isInfo {
+		printMetadata(w, item.Metadata, len(item.Content), item.StoredAt)
+		return nil
 	}
+	_, err := item.WriteTo(w)
+	return err
 }
 
-func (client *Client) pasteOperation(h1 []byte, isMove bool) {
-	conf, reader, writer := client.conf, client.reader, client.writer
-	opcode := byte('G')
-	if isMove {
-		opcode = byte('M')
-	}
-	h2 := auth2get(conf, client.version, h1, opcode)
-	writer.WriteByte(opcode)
-	writer.Write(h2)
-	if err := writer.Flush(); err != nil {
-		log.Fatal(err)
-	}
-	rbuf := make([]byte, 112)
-	if nbread, err := io.ReadFull(reader, rbuf); err != nil {
-		if err == io.ErrUnexpectedEOF {
-			if nbread < 80 {
-				log.Fatal("The clipboard might be empty")
-			} else {
-				log.Fatal("The server may be running an incompatible version")
-			}
-		} else {
-			log.Fatal(err)
+func printMetadata(out io.Writer, metadata *client.Metadata, contentLen int, ts time.Time) {
+	if metadata == nil {
+		fmt.Fprintf(out, "Metadata: none\n")
+		fmt.Fprintf(out, "Size:     %v\n", contentLen)
+	} else {
+		if metadata.Name != "" {
+			fmt.Fprintf(out, "Name:     %v\n", metadata.Name)
 		}
-	}
-	h3 := rbuf[0:32]
-	ciphertextWithEncryptSkIDAndNonceLen := binary.LittleEndian.Uint64(rbuf[32:40])
-	ts := rbuf[40:48]
-	signature := rbuf[48:112]
-	wh3 := auth3get(conf, client.version, h2, ts, signature)
-	if subtle.ConstantTimeCompare(wh3, h3) != 1 {
-		log.Fatal("Incorrect authentication code")
-	}
-	elapsed := time.Since(time.Unix(int64(binary.LittleEndian.Uint64(ts)), 0))
-	if elapsed >= conf.TTL {
-		log.Fatal("Clipboard content is too old")
-	}
-	if ciphertextWithEncryptSkIDAndNonceLen < 8+24 {
-		log.Fatal("Clipboard content is too short")
-	}
-	ciphertextWithEncryptSkIDAndNonce := make([]byte, ciphertextWithEncryptSkIDAndNonceLen)
-	client.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
-	if _, err := io.ReadFull(reader, ciphertextWithEncryptSkIDAndNonce); err != nil {
-		if err == io.ErrUnexpectedEOF {
-			log.Fatal("The server may be running an incompatible version")
-		} else {
-			log.Fatal(err)
+		if metadata.MIMEType != "" {
+			fmt.Fprintf(out, "Type:     %v\n", metadata.MIMEType)
+		}
+		size := metadata.Size
+		if size < 0 {
+			size = int64(contentLen)
+		}
+		fmt.Fprintf(out, "Size:     %v\n", size)
+		if metadata.Mode != 0 {
+			fmt.Fprintf(out, "Mode:     %v\n", metadata.Mode)
+		}
+		if metadata.Hostname != "" {
+			fmt.Fprintf(out, "Hostname: %v\n", metadata.Hostname)
+		}
+		if metadata.Compression != client.CompressionNone {
+			fmt.Fprintf(out, "Encoding: %v (%v bytes compressed)\n", client.CompressionName(metadata.Compression), contentLen)
 		}
 	}
-	encryptSkID := ciphertextWithEncryptSkIDAndNonce[0:8]
-	if !bytes.Equal(conf.EncryptSkID, encryptSkID) {
-		wEncryptSkIDStr := binary.LittleEndian.Uint64(conf.EncryptSkID)
-		encryptSkIDStr := binary.LittleEndian.Uint64(encryptSkID)
-		log.Fatalf("Configured key ID is %v but content was encrypted using key ID %v",
-			wEncryptSkIDStr, encryptSkIDStr)
-	}
-	if !ed25519.Verify(conf.SignPk, ciphertextWithEncryptSkIDAndNonce, signature) {
-		log.Fatal("Signature doesn't verify")
-	}
-	nonce := ciphertextWithEncryptSkIDAndNonce[8:32]
-	cipher, err := chacha20.NewUnauthenticatedCipher(conf.EncryptSk, nonce)
-	if err != nil {
-		log.Fatal(err)
-	}
-	content := ciphertextWithEncryptSkIDAndNonce[32:]
-	cipher.XORKeyStream(content, content)
-	binary.Write(os.Stdout, binary.LittleEndian, content)
+	fmt.Fprintf(out, "Stored:   %v (%v ago)\n", ts.Format(time.RFC3339), time.Since(ts).Truncate(time.Second))
 }
 
-func (client *Client) pushStreamOperation(h1 []byte, cid string) {
-	conf, reader, writer := client.conf, client.reader, client.writer
-	opcode := byte('P')
-	h2 := auth2get(conf, client.version, h1, opcode)
-	writer.WriteByte(opcode)
-	writer.Write(h2)
-	if err := writer.Flush(); err != nil {
-		log.Fatal(err)
-	}
+func printStatus(out io.Writer, status *client.Status) {
+	fmt.Fprintf(out, "Stored size: %v\n", status.StoredSize)
+	fmt.Fprintf(out, "Stored at:   %v (%v ago)\n", status.StoredAt.Format(time.RFC3339), time.Since(status.StoredAt).Truncate(time.Second))
+	fmt.Fprintf(out, "Key ID:      %v\n", status.KeyID)
+	fmt.Fprintf(out, "Content:     %x\n", status.Digest)
+}
 
-	client.conn.SetDeadline(time.Now().Add(conf.Timeout))
-	statusBuf := make([]byte, 1)
-	if _, err := io.ReadFull(reader, statusBuf); err != nil {
-		if err == io.ErrUnexpectedEOF {
-			log.Fatal("The server may be running an incompatible version")
+// printStreamAcks - Reports whether each puller verified a stream
+func printStreamAcks(result *client.PushResult) {
+	for i, ack := range result.Acks {
+		switch ack.Status {
+		case client.AckMissing:
+			fmt.Fprintf(os.Stderr, "Puller %v: no acknowledgement\n", i+1)
+		case client.AckInvalid:
+			fmt.Fprintf(os.Stderr, "Puller %v: invalid acknowledgement\n", i+1)
+		case client.AckFailed:
+			fmt.Fprintf(os.Stderr, "Puller %v (%s): verification failed\n", i+1, ack.Hostname)
+		case client.AckVerified:
+			fmt.Fprintf(os.Stderr, "Puller %v (%s): verified\n", i+1, ack.Hostname)
 		}
-		log.Fatal(err)
-	}
-	switch statusBuf[0] {
-	case 0x01:
-	case 0x00:
-		log.Fatal("No clients are waiting to receive the stream")
-	case 0x02:
-		log.Fatal("Another push is already active")
-	default:
-		log.Fatal("Server rejected the stream")
-	}
-
-	cidBytes := []byte(cid)
-
-	ts := make([]byte, 8)
-	binary.LittleEndian.PutUint64(ts, uint64(time.Now().Unix()))
-
-	noncePrefix := make([]byte, 16)
-	if _, err := rand.Read(noncePrefix); err != nil {
-		log.Fatal(err)
-	}
-
-	streamKey := deriveStreamKey(conf.EncryptSk, ts, conf.EncryptSkID, noncePrefix, cidBytes)
-	aead, err := chacha20poly1305.NewX(streamKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	cidBind := computeCIDBind(conf.EncryptSk, cidBytes)
-	transcript := newTranscriptHash()
-	transcript.Write([]byte{client.version})
-	transcript.Write([]byte{opcode})
-	transcript.Write(ts)
-	transcript.Write(conf.EncryptSkID)
-	transcript.Write(noncePrefix)
-	transcript.Write(cidBind)
-
-	header := make([]byte, 32)
-	copy(header[0:8], ts)
-	copy(header[8:16], conf.EncryptSkID)
-	copy(header[16:32], noncePrefix)
-
-	client.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
-	writer.Write(header)
-	if err := writer.Flush(); err != nil {
-		log.Fatal(err)
 	}
-
-	plainBuf := make([]byte, MaxChunk)
-	var chunkIndex uint64
-
-	for {
-		n, readErr := io.ReadAtLeast(os.Stdin, plainBuf, 1)
-		if n > 0 {
-			nonce := deriveChunkNonce(noncePrefix, chunkIndex)
-			sealed := aead.Seal(nil, nonce, plainBuf[:n], nil)
-
-			chunkLen := uint32(n)
-			lenBuf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(lenBuf, chunkLen)
-
-			idxBuf := make([]byte, 8)
-			binary.LittleEndian.PutUint64(idxBuf, chunkIndex)
-			transcript.Write(idxBuf)
-			transcript.Write(lenBuf)
-			transcript.Write(sealed)
-
-			client.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
-			writer.Write(lenBuf)
-			writer.Write(sealed)
-			if err := writer.Flush(); err != nil {
-				log.Fatal(err)
-			}
-			chunkIndex++
-		}
-		if readErr != nil {
-			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
-				break
-			}
-			log.Fatal(readErr)
-		}
+	if result.Left > 0 {
+		fmt.Fprintf(os.Stderr, "%v pullers left before the end of the stream\n", result.Left)
 	}
+}
 
-	transcriptDigest := transcript.Sum(nil)
-	signature := ed25519.Sign(conf.SignSk, transcriptDigest)
-
-	endMarker := make([]byte, 4)
-	client.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
-	writer.Write(endMarker)
-	writer.Write(signature)
-	if err := writer.Flush(); err != nil {
+// RunPing - Check that the server is reachable and that the handshake succeeds
+func RunPing(conf Conf) {
+	if err := newClient(conf).Ping(context.Background()); err != nil {
 		log.Fatal(err)
 	}
-
 	if IsTerminal(int(syscall.Stderr)) {
-		os.Stderr.WriteString("Stream sent\n")
+		os.Stderr.WriteString("The server is alive\n")
 	}
 }
 
-func (client *Client) pullStreamOperation(h1 []byte, cid string) {
-	conf, reader, writer := client.conf, client.reader, client.writer
-	opcode := byte('L')
-	h2 := auth2get(conf, client.version, h1, opcode)
-	writer.WriteByte(opcode)
-	writer.Write(h2)
-	if err := writer.Flush(); err != nil {
-		log.Fatal(err)
-	}
-
-	client.conn.SetDeadline(time.Now().Add(conf.Timeout))
-	statusBuf := make([]byte, 1)
-	if _, err := io.ReadFull(reader, statusBuf); err != nil {
-		if err == io.ErrUnexpectedEOF {
-			log.Fatal("The server may be running an incompatible version")
+func RunClient(conf Conf, opts ClientOptions) {
+	c := newClient(conf)
+	ctx := context.Background()
+	var input io.Reader = os.Stdin
+	var output io.Writer = os.Stdout
+	name, mimeType := opts.Name, opts.MIMEType
+
+	if len(opts.Files) > 0 {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeArchive(pw, opts.Files))
+		}()
+		input = pr
+		name, mimeType = "", ArchiveMIMEType
+	}
+	var err error
+	var outputFile *atomicFile
+	if opts.Output != "" {
+		if outputFile, err = createAtomicFile(opts.Output); err != nil {
+			log.Fatal(err)
 		}
-		log.Fatal(err)
-	}
-	switch statusBuf[0] {
-	case 0x01:
-	case 0x00:
-		log.Fatal("A stream is already being transferred - try again later")
-	case 0x02:
-		log.Fatal("Too many clients are already waiting to receive a stream")
-	default:
-		log.Fatal("Server rejected the stream pull request")
-	}
-
-	cidBytes := []byte(cid)
-
-	client.conn.SetDeadline(time.Time{})
-
-	header := make([]byte, 32)
-	if _, err := io.ReadFull(reader, header); err != nil {
-		log.Fatal("Stream: failed to read header: ", err)
+		output = outputFile
 	}
-
-	ts := header[0:8]
-	encryptSkID := header[8:16]
-	noncePrefix := header[16:32]
-
-	tsRaw := binary.LittleEndian.Uint64(ts)
-	if tsRaw > uint64(math.MaxInt64) {
-		log.Fatal("Stream rejected: invalid timestamp")
-	}
-	tsVal := int64(tsRaw)
-	now := time.Now().Unix()
-	maxFutureSeconds := int64(MaxFutureSkew / time.Second)
-	ttlSeconds := int64(conf.TTL / time.Second)
-	if tsVal > now {
-		if tsVal-now > maxFutureSeconds {
-			log.Fatal("Stream rejected: timestamp too far in the future")
+	var pasteTo *extraction
+	if opts.PasteTo != "" {
+		if pasteTo, err = startExtraction(opts.PasteTo); err != nil {
+			log.Fatal(err)
 		}
-	} else {
-		if now-tsVal > ttlSeconds {
-			log.Fatal("Stream rejected: timestamp too old")
+		output = pasteTo
+	}
+
+	var progress *transferProgress
+	if opts.Stats || IsTerminal(int(syscall.Stderr)) {
+		operation := ""
+		if opts.IsCopy {
+			operation = "copy"
+		} else if opts.IsPush {
+			operation = "push"
+		} else if opts.IsPull {
+			operation = "pull"
+		} else if opts.IsMove {
+			operation = "move"
+		} else if !opts.IsStatus && !opts.IsClear && !opts.IsWatch {
+			operation = "paste"
+		}
+		if operation != "" {
+			show := IsTerminal(int(syscall.Stderr)) &&
+				(opts.IsCopy || opts.IsPush || opts.Output != "" || opts.PasteTo != "" || !IsTerminal(int(syscall.Stdout)))
+			progress = newTransferProgress(operation, show)
+			input, output = progress.reader(input), progress.writer(output)
 		}
 	}
+	pasteOpts := &client.PasteOptions{Wait: opts.Wait, Progress: progress.asProgress()}
 
-	if !bytes.Equal(conf.EncryptSkID, encryptSkID) {
-		wEncryptSkIDStr := binary.LittleEndian.Uint64(conf.EncryptSkID)
-		encryptSkIDStr := binary.LittleEndian.Uint64(encryptSkID)
-		log.Fatalf("Configured key ID is %v but stream was encrypted using key ID %v",
-			wEncryptSkIDStr, encryptSkIDStr)
-	}
-
-	streamKey := deriveStreamKey(conf.EncryptSk, ts, encryptSkID, noncePrefix, cidBytes)
-	aead, err := chacha20poly1305.NewX(streamKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	cidBind := computeCIDBind(conf.EncryptSk, cidBytes)
-	transcript := newTranscriptHash()
-	transcript.Write([]byte{client.version})
-	transcript.Write([]byte{'P'})
-	transcript.Write(ts)
-	transcript.Write(encryptSkID)
-	transcript.Write(noncePrefix)
-	transcript.Write(cidBind)
-
-	_ = writer
-
-	var chunkIndex uint64
-	var totalBytes uint64
-	pullStart := time.Now()
-	maxBytes := DefaultMaxStreamBytes
-	if conf.MaxStreamBytes > 0 && conf.MaxStreamBytes < maxBytes {
-		maxBytes = conf.MaxStreamBytes
-	}
-	maxDur := DefaultMaxStreamDur
-	if conf.MaxStreamDuration > 0 && conf.MaxStreamDuration < maxDur {
-		maxDur = conf.MaxStreamDuration
-	}
-
-	for {
-		client.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
-		var chunkLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &chunkLen); err != nil {
-			log.Fatal("Stream: failed to read chunk length: ", err)
+	done := ""
+	committed := false
+	commit := func() error {
+		if committed {
+			return nil
 		}
-
-		if chunkLen == 0 {
-			sig := make([]byte, 64)
-			if _, err := io.ReadFull(reader, sig); err != nil {
-				log.Fatal("Stream: failed to read signature: ", err)
+		committed = true
+		if outputFile != nil {
+			if err := outputFile.commit(); err != nil {
+				return err
 			}
-			transcriptDigest := transcript.Sum(nil)
-			if !ed25519.Verify(conf.SignPk, transcriptDigest, sig) {
-				log.Fatal("Stream signature verification failed")
-			}
-			return
-		}
-
-		if chunkLen > MaxChunk {
-			log.Fatalf("Stream: chunk too large (%v > %v)", chunkLen, MaxChunk)
-		}
-
-		sealedLen := int(chunkLen) + 16
-		totalBytes += uint64(sealedLen)
-		if totalBytes > maxBytes {
-			log.Fatal("Stream rejected: exceeded maximum stream size")
 		}
-		if time.Since(pullStart) > maxDur {
-			log.Fatal("Stream rejected: exceeded maximum stream duration")
+		if pasteTo != nil {
+			count, err := pasteTo.commit()
+			if err != nil {
+				return err
+			}
+			done = fmt.Sprintf("%v files extracted into [%v]\n", count, opts.PasteTo)
 		}
-		sealed := make([]byte, sealedLen)
-		client.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
-		if _, err := io.ReadFull(reader, sealed); err != nil {
-			log.Fatal("Stream: failed to read chunk data: ", err)
+		return nil
+	}
+	if opts.IsStatus {
+		var status *client.Status
+		if status, err = c.Status(ctx); status != nil {
+			printStatus(output, status)
 		}
-
-		nonce := deriveChunkNonce(noncePrefix, chunkIndex)
-		plain, err := aead.Open(nil, nonce, sealed, nil)
-		if err != nil {
-			log.Fatal("Stream: AEAD authentication failed for chunk ", chunkIndex)
+	} else if opts.IsClear {
+		err = c.Clear(ctx)
+		done = "Cleared\n"
+	} else if opts.IsWatch {
+		err = c.Watch(ctx, func(item *client.Item) error {
+			if opts.Exec == "" {
+				return writeItem(output, item, opts.IsInfo)
+			}
+			var content bytes.Buffer
+			if err := writeItem(&content, item, opts.IsInfo); err != nil {
+				return err
+			}
+			if err := runCommand(opts.Exec, &content); err != nil {
+				log.Printf("Command [%v] failed: %v", opts.Exec, err)
+			}
+			return nil
+		})
+	} else if opts.IsCopy {
+		err = c.Copy(ctx, input, &client.CopyOptions{
+			Name:     name,
+			MIMEType: mimeType,
+			Retries:  opts.Retries,
+			Progress: progress.asProgress(),
+		})
+		done = "Sent\n"
+	} else if opts.IsPush {
+		var result *client.PushResult
+		result, err = c.Push(ctx, input, &client.PushOptions{
+			CID:         opts.CID,
+			Name:        name,
+			MIMEType:    mimeType,
+			WaitPullers: opts.WaitPullers,
+			WaitTimeout: opts.WaitTimeout,
+			Replay:      opts.Replay,
+			Store:       opts.Store,
+			Ack:         opts.Ack,
+			Started: func(pullers uint32) {
+				if opts.WaitPullers > 0 && IsTerminal(int(syscall.Stderr)) {
+					fmt.Fprintf(os.Stderr, "Streaming to %v pullers\n", pullers)
+				}
+			},
+			Progress: progress.asProgress(),
+		})
+		if result != nil && opts.Ack {
+			printStreamAcks(result)
 		}
-
-		lenBuf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(lenBuf, chunkLen)
-		idxBuf := make([]byte, 8)
-		binary.LittleEndian.PutUint64(idxBuf, chunkIndex)
-		transcript.Write(idxBuf)
-		transcript.Write(lenBuf)
-		transcript.Write(sealed)
-
-		if _, err := os.Stdout.Write(plain); err != nil {
-			log.Fatal("Stream: write error: ", err)
+		done = "Stream sent\n"
+	} else if opts.IsPull {
+		err = c.Pull(ctx, output, &client.PullOptions{
+			CID:      opts.CID,
+			Store:    opts.Store,
+			Retries:  opts.Retries,
+			Verified: commit,
+			Progress: progress.asProgress(),
+		})
+	} else if opts.IsMove {
+		err = c.Move(ctx, output, pasteOpts)
+	} else {
+		var item *client.Item
+		if item, err = c.Get(ctx, pasteOpts); err == nil {
+			err = writeItem(output, item, opts.IsInfo)
 		}
-		chunkIndex++
 	}
-}
-
-func RunClient(conf Conf, isCopy bool, isMove bool, isPush bool, isPull bool, cid string) {
-	conn, err := net.DialTimeout("tcp", conf.Connect, conf.Timeout)
-	if err != nil {
-		log.Fatalf("Unable to connect to %v - Is a Piknik server running on that host?",
-			conf.Connect)
-	}
-	defer conn.Close()
-
-	clientVersion := byte(7)
-	if !isPush && !isPull {
-		clientVersion = byte(6)
-	}
-
-	conn.SetDeadline(time.Now().Add(conf.Timeout))
-	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
-	client := Client{
-		conf:    conf,
-		conn:    conn,
-		reader:  reader,
-		writer:  writer,
-		version: clientVersion,
-	}
-	r := make([]byte, 32)
-	if _, err = rand.Read(r); err != nil {
-		log.Fatal(err)
-	}
-	h0 := auth0(conf, client.version, r)
-	writer.Write([]byte{client.version})
-	writer.Write(r)
-	writer.Write(h0)
-	if err := writer.Flush(); err != nil {
-		log.Fatal(err)
+	if err == nil {
+		err = commit()
 	}
-	rbuf := make([]byte, 65)
-	if nbread, err := io.ReadFull(reader, rbuf); err != nil {
-		if nbread < 2 {
-			log.Fatal("The server rejected the connection - Check that it is running the same Piknik version or retry later")
-		} else {
-			log.Fatal("The server doesn't support this protocol")
+	progress.finish()
+	if err != nil {
+		if outputFile != nil {
+			outputFile.abort()
 		}
+		if pasteTo != nil {
+			pasteTo.abort(err)
+		}
+		log.Fatal(err)
 	}
-	if serverVersion := rbuf[0]; serverVersion != client.version {
-		log.Fatalf("Incompatible server version (client version: %v - server version: %v)",
-			client.version, serverVersion)
-	}
-	r2 := rbuf[1:33]
-	h1 := rbuf[33:65]
-	wh1 := auth1(conf, client.version, h0, r2)
-	if subtle.ConstantTimeCompare(wh1, h1) != 1 {
-		log.Fatal("Incorrect authentication code")
+	if done != "" && IsTerminal(int(syscall.Stderr)) {
+		os.Stderr.WriteString(done)
 	}
-	if isCopy {
-		client.copyOperation(h1)
-	} else if isPush {
-		client.pushStreamOperation(h1, cid)
-	} else if isPull {
-		client.pullStreamOperation(h1, cid)
-	} else {
-		client.pasteOperation(h1, isMove)
+	if opts.Stats {
+		progress.printStats(os.Stderr)
 	}
 }
@@ -0,0 +1,300 @@
+// Package client - Piknik client, to copy and paste content and to push and
+// pull streams through a Piknik server.
+//
+// Content is encrypted and signed before it leaves the client, and verified
+// and decrypted once received, using the keys of the configuration. Errors
+// are returned, never logged, and the common failures can be checked with
+// errors.Is using the Err* values.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"github.com/jedisct1/piknik/internal/ratelimit"
+)
+
+const (
+	// ProtocolVersion - Latest protocol version supported by the client
+	ProtocolVersion = protocol.Version
+
+	DefaultMaxStreamBytes = uint64(10 * 1024 * 1024 * 1024)
+	DefaultMaxStreamDur   = 24 * time.Hour
+
+	RetryInterval = 2 * time.Second
+)
+
+var (
+	// ErrEmpty - The clipboard is empty, or its content has been moved
+	ErrEmpty = errors.New("The clipboard might be empty")
+	// ErrTooOld - The content is older than the configured TTL
+	ErrTooOld = errors.New("Clipboard content is too old")
+	// ErrKeyIDMismatch - The content was encrypted using another key
+	ErrKeyIDMismatch = errors.New("Key ID mismatch")
+	// ErrBadSignature - The signature of the content doesn't verify
+	ErrBadSignature = errors.New("Signature doesn't verify")
+	// ErrIncompatibleVersion - The server doesn't speak the same protocol
+	ErrIncompatibleVersion = errors.New("The server may be running an incompatible version")
+	// ErrNoLiveStream - No live stream is being pushed on the channel
+	ErrNoLiveStream = errors.New("No live stream is being pushed on this channel")
+
+	errIncorrectAuthCode = errors.New("Incorrect authentication code")
+	errRejected          = errors.New("The server rejected the connection - Check that it is running the same Piknik version or retry later")
+)
+
+// detailedError - Error with a specific message, matching one of the Err*
+// values with errors.Is
+type detailedError struct {
+	msg string
+	err error
+}
+
+func (e *detailedError) Error() string { return e.msg }
+
+func (e *detailedError) Unwrap() error { return e.err }
+
+func errorf(err error, format string, args ...any) error {
+	return &detailedError{msg: fmt.Sprintf(format, args...), err: err}
+}
+
+// keyIDMismatch - Error for content encrypted using another key ID
+func keyIDMismatch(conf Config, what string, encryptSkID []byte) error {
+	return errorf(ErrKeyIDMismatch, "Configured key ID is %v but %v was encrypted using key ID %v",
+		binary.LittleEndian.Uint64(conf.EncryptSkID), what, binary.LittleEndian.Uint64(encryptSkID))
+}
+
+// Config - Server address, keys and limits of a client
+type Config struct {
+	Connect             string
+	Psk                 []byte
+	SignPk              []byte
+	SignSk              []byte
+	EncryptSk           []byte
+	EncryptSkID         []byte
+	Timeout             time.Duration
+	DataTimeout         time.Duration
+	TTL                 time.Duration
+	MaxStreamBytes      uint64
+	MaxStreamDuration   time.Duration
+	Compression         string
+	MaxDecompressedSize int64
+	LimitRate           uint64
+
+	// ErrorLog - Where to report errors that an operation recovers from,
+	// such as lost connections. Nothing is reported if nil.
+	ErrorLog *log.Logger
+}
+
+// Client - A Piknik client. Every operation uses a new connection, and a
+// client can run several operations simultaneously.
+type Client struct {
+	conf      Config
+	bandwidth *ratelimit.Bucket
+}
+
+// New - Creates a client. Timeouts, TTL and limits that are not set use the
+// same defaults as the command-line client.
+func New(conf Config) (*Client, error) {
+	if len(conf.Psk) != 32 || len(conf.SignPk) != 32 {
+		return nil, errors.New("The Psk and SignPk keys must be 32 bytes long")
+	}
+	if len(conf.EncryptSk) != 32 || len(conf.SignSk) != 64 || len(conf.EncryptSkID) != 8 {
+		return nil, errors.New("The EncryptSk, EncryptSkID and SignSk keys must be present and valid")
+	}
+	if conf.Compression == "" {
+		conf.Compression = "none"
+	}
+	if !ValidCompressionMode(conf.Compression) {
+		return nil, fmt.Errorf("Unsupported compression mode [%v]", conf.Compression)
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 10 * time.Second
+	}
+	if conf.DataTimeout <= 0 {
+		conf.DataTimeout = time.Hour
+	}
+	if conf.TTL <= 0 {
+		conf.TTL = 7 * 24 * time.Hour
+	}
+	if conf.MaxStreamBytes == 0 {
+		conf.MaxStreamBytes = DefaultMaxStreamBytes
+	}
+	if conf.MaxStreamDuration <= 0 {
+		conf.MaxStreamDuration = DefaultMaxStreamDur
+	}
+	if conf.MaxDecompressedSize <= 0 {
+		conf.MaxDecompressedSize = DefaultMaxDecompressedSize
+	}
+	return &Client{conf: conf, bandwidth: ratelimit.NewBucket(conf.LimitRate)}, nil
+}
+
+func (c *Client) logf(format string, args ...any) {
+	if c.conf.ErrorLog != nil {
+		c.conf.ErrorLog.Printf(format, args...)
+	}
+}
+
+// connection - A connection to the server, used by a single operation
+type connection struct {
+	client   *Client
+	conf     Config
+	conn     net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	version  byte
+	progress progress
+	stop     func() bool
+}
+
+// connect - Connects to the server, and completes the handshake. The
+// connection is closed if ctx is canceled.
+func (c *Client) connect(ctx context.Context, version byte) (*connection, []byte, error) {
+	conf := c.conf
+	dialer := net.Dialer{Timeout: conf.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", conf.Connect)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("Unable to connect to %v - Is a Piknik server running on that host?",
+			conf.Connect)
+	}
+	conn.SetDeadline(time.Now().Add(conf.Timeout))
+	limitedReader, limitedWriter := ratelimit.Limit(conn, c.bandwidth)
+	cnx := &connection{
+		client:  c,
+		conf:    conf,
+		conn:    conn,
+		reader:  bufio.NewReader(limitedReader),
+		writer:  bufio.NewWriter(limitedWriter),
+		version: version,
+		stop:    context.AfterFunc(ctx, func() { conn.Close() }),
+	}
+	h1, err := cnx.handshake()
+	if err != nil {
+		cnx.close()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if err == errRejected && version > 6 && c.accepts(ctx, 6) {
+			return nil, nil, errorf(ErrIncompatibleVersion,
+				"The server doesn't support protocol version %v, required by this operation - Please upgrade it", version)
+		}
+		return nil, nil, err
+	}
+	return cnx, h1, nil
+}
+
+// accepts - Whether the server accepts connections using a protocol version.
+// Servers close connections using versions they don't support without
+// telling why, so this tells an outdated server from a busy one
+func (c *Client) accepts(ctx context.Context, version byte) bool {
+	cnx, _, err := c.connect(ctx, version)
+	if err != nil {
+		return false
+	}
+	cnx.close()
+	return true
+}
+
+func (cnx *connection) close() {
+	cnx.stop()
+	cnx.conn.Close()
+}
+
+func (cnx *connection) handshake() ([]byte, error) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return nil, err
+	}
+	h0 := protocol.Auth0(conf.Psk, cnx.version, r)
+	writer.Write([]byte{cnx.version})
+	writer.Write(r)
+	writer.Write(h0)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	rbuf := make([]byte, 65)
+	if nbread, err := io.ReadFull(reader, rbuf); err != nil {
+		if nbread < 2 {
+			return nil, errRejected
+		}
+		return nil, errorf(ErrIncompatibleVersion, "The server doesn't support this protocol")
+	}
+	if serverVersion := rbuf[0]; serverVersion != cnx.version {
+		return nil, errorf(ErrIncompatibleVersion, "Incompatible server version (client version: %v - server version: %v)",
+			cnx.version, serverVersion)
+	}
+	r2 := rbuf[1:33]
+	h1 := rbuf[33:65]
+	wh1 := protocol.Auth1(conf.Psk, cnx.version, h0, r2)
+	if subtle.ConstantTimeCompare(wh1, h1) != 1 {
+		return nil, errIncorrectAuthCode
+	}
+	return h1, nil
+}
+
+// run - Runs an operation on a new connection
+func (c *Client) run(ctx context.Context, version byte, operation func(cnx *connection, h1 []byte) error) error {
+	cnx, h1, err := c.connect(ctx, version)
+	if err != nil {
+		return err
+	}
+	defer cnx.close()
+	err = operation(cnx, h1)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// interrupted - Whether an operation failed because the connection was lost
+func interrupted(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// withRetries - Runs an operation, reconnecting and running it again up to
+// retries times if the connection is lost
+func (cnx *connection) withRetries(ctx context.Context, h1 []byte, retries uint,
+	operation func(cnx *connection, h1 []byte) error,
+) error {
+	c := cnx.client
+	err := operation(cnx, h1)
+	for ; err != nil && retries > 0 && interrupted(err) && ctx.Err() == nil; retries-- {
+		c.logf("%v - Reconnecting in %v", err, RetryInterval)
+		select {
+		case <-time.After(RetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		retry, h1, connectErr := c.connect(ctx, cnx.version)
+		if connectErr != nil {
+			c.logf("%v", connectErr)
+			continue
+		}
+		retry.progress = cnx.progress
+		err = operation(retry, h1)
+		retry.close()
+	}
+	return err
+}
+
+// Ping - Checks that the server is reachable and that the handshake succeeds,
+// using the oldest protocol version, that every server supports
+func (c *Client) Ping(ctx context.Context) error {
+	return c.run(ctx, 6, func(cnx *connection, h1 []byte) error {
+		return nil
+	})
+}
@@ -0,0 +1,201 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+	"github.com/jedisct1/piknik/internal/protocol"
+	"github.com/jedisct1/piknik/internal/testutil"
+	"github.com/jedisct1/piknik/server"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testServer - Starts a server on a local port until the test ends, and
+// returns a client configuration to use it
+func testServer(t *testing.T) client.Config {
+	t.Helper()
+	conf := testutil.ClientConfig(t)
+	srv, err := server.New(server.Config{Psk: conf.Psk, SignPk: conf.SignPk, ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Connect = testutil.Start(t, srv)
+	return conf
+}
+
+func TestCopyPaste(t *testing.T) {
+	c := testutil.NewClient(t, testServer(t))
+	ctx := context.Background()
+	content := []byte("clipboard content")
+	if err := c.Copy(ctx, bytes.NewReader(content), &client.CopyOptions{Name: "notes.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.Get(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(item.Content, content) {
+		t.Fatalf("content = %q, want %q", item.Content, content)
+	}
+	if item.Metadata == nil || item.Metadata.Name != "notes.txt" {
+		t.Fatalf("metadata = %+v, want the name to be kept", item.Metadata)
+	}
+
+	var moved bytes.Buffer
+	if err := c.Move(ctx, &moved, nil); err != nil || !bytes.Equal(moved.Bytes(), content) {
+		t.Fatalf("Move() = %q, %v", moved.Bytes(), err)
+	}
+	if err := c.Paste(ctx, io.Discard, nil); !errors.Is(err, client.ErrEmpty) {
+		t.Fatalf("Paste() after Move() = %v, want %v", err, client.ErrEmpty)
+	}
+}
+
+func TestPasteErrors(t *testing.T) {
+	conf := testServer(t)
+	ctx := context.Background()
+	c := testutil.NewClient(t, conf)
+	if err := c.Paste(ctx, io.Discard, nil); !errors.Is(err, client.ErrEmpty) {
+		t.Fatalf("Paste() = %v, want %v", err, client.ErrEmpty)
+	}
+	if err := c.Copy(ctx, bytes.NewReader([]byte("content")), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tooOld := conf
+	tooOld.TTL = time.Nanosecond
+	otherKeyID := conf
+	otherKeyID.EncryptSkID = bytes.Repeat([]byte{0xff}, 8)
+	otherSigner := conf
+	otherSigner.SignPk, otherSigner.SignSk, _ = ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name string
+		conf client.Config
+		want error
+	}{
+		{"TTL expired", tooOld, client.ErrTooOld},
+		{"other key ID", otherKeyID, client.ErrKeyIDMismatch},
+		{"other signing key", otherSigner, client.ErrBadSignature},
+	}
+	for _, test := range tests {
+		err := testutil.NewClient(t, test.conf).Paste(ctx, io.Discard, nil)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%v: Paste() = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+// fakeServer - Accepts connections, reads the handshake and replies with
+// reply before closing the connection
+func fakeServer(t *testing.T, reply []byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(conn, make([]byte, 65))
+			conn.Write(reply)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestIncompatibleVersion(t *testing.T) {
+	conf := testServer(t)
+	oldVersion := append([]byte{5}, make([]byte, 64)...)
+	tests := []struct {
+		name  string
+		reply []byte
+	}{
+		{"old server version", oldVersion},
+		{"truncated handshake", oldVersion[:10]},
+	}
+	for _, test := range tests {
+		conf.Connect = fakeServer(t, test.reply)
+		err := testutil.NewClient(t, conf).Ping(context.Background())
+		if !errors.Is(err, client.ErrIncompatibleVersion) {
+			t.Errorf("%v: Ping() = %v, want %v", test.name, err, client.ErrIncompatibleVersion)
+		}
+	}
+}
+
+// oldServer - Accepts connections, and only completes the handshakes using
+// protocol version 6, like servers predating the other versions
+func oldServer(t *testing.T, psk []byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			rbuf := make([]byte, 65)
+			if _, err := io.ReadFull(conn, rbuf); err == nil && rbuf[0] == 6 {
+				r2 := make([]byte, 32)
+				rand.Read(r2)
+				conn.Write(append(append([]byte{6}, r2...), protocol.Auth1(psk, 6, rbuf[33:], r2)...))
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestOldServer(t *testing.T) {
+	conf := testServer(t)
+	conf.Connect = oldServer(t, conf.Psk)
+	c := testutil.NewClient(t, conf)
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if _, err := c.Push(ctx, bytes.NewReader(nil), nil); !errors.Is(err, client.ErrIncompatibleVersion) {
+		t.Errorf("Push() = %v, want %v", err, client.ErrIncompatibleVersion)
+	}
+	if err := c.Pull(ctx, io.Discard, nil); !errors.Is(err, client.ErrIncompatibleVersion) {
+		t.Errorf("Pull() = %v, want %v", err, client.ErrIncompatibleVersion)
+	}
+}
+
+func TestNoLiveStream(t *testing.T) {
+	c := testutil.NewClient(t, testServer(t))
+	if _, err := c.PullLive(context.Background(), "cid"); !errors.Is(err, client.ErrNoLiveStream) {
+		t.Fatalf("PullLive() = %v, want %v", err, client.ErrNoLiveStream)
+	}
+}
+
+func TestCopyAlwaysSendsMetadata(t *testing.T) {
+	c := testutil.NewClient(t, testServer(t))
+	ctx := context.Background()
+	content := []byte("no name, no type")
+	if err := c.Copy(ctx, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.Get(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Metadata == nil || item.Metadata.Size != int64(len(content)) {
+		t.Fatalf("metadata = %+v, want the size to be recorded", item.Metadata)
+	}
+}
@@ -0,0 +1,504 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/ed25519"
+)
+
+// CopyOptions - Options of a copy
+type CopyOptions struct {
+	// Name - File name to record in the metadata
+	Name string
+	// MIMEType - Type to record in the metadata, guessed if empty
+	MIMEType string
+	// Retries - Number of times to reconnect and resume the upload if the
+	// connection is lost
+	Retries  uint
+	Progress Progress
+}
+
+// PasteOptions - Options of a paste or a move
+type PasteOptions struct {
+	// Wait - Wait up to this duration for new content to be copied,
+	// instead of retrieving the current content
+	Wait     time.Duration
+	Progress Progress
+}
+
+// Item - Clipboard content, once verified and decrypted
+type Item struct {
+	// Metadata - Metadata sent along with the content, nil if there was
+	// none
+	Metadata *Metadata
+	StoredAt time.Time
+	// Content - Content, compressed if the metadata says so
+	Content []byte
+
+	maxDecompressedSize int64
+}
+
+// WriteTo - Writes the content, decompressing it if necessary
+func (item *Item) WriteTo(w io.Writer) (int64, error) {
+	metadata := item.Metadata
+	if metadata == nil || metadata.Compression == CompressionNone {
+		n, err := w.Write(item.Content)
+		return int64(n), err
+	}
+	counter := &countingWriter{w: w}
+	err := decompressTo(metadata.Compression, counter, bytes.NewReader(item.Content),
+		item.maxDecompressedSize, metadata.Size)
+	return counter.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Status - Information about the clipboard content, as known by the server
+type Status struct {
+	// StoredSize - Size of the content as stored, including its metadata,
+	// and compressed if it was copied with compression. The original size
+	// is only known once the content is retrieved.
+	StoredSize uint64
+	StoredAt   time.Time
+	KeyID      uint64
+	// Digest - Prefix of the signature, identifying the content
+	Digest []byte
+}
+
+// Copy - Stores the content read from r. If r has a Stat method, like
+// *os.File, the permissions of a regular file are recorded in the metadata.
+func (c *Client) Copy(ctx context.Context, r io.Reader, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	version := byte(6)
+	if opts.Retries > 0 {
+		version = 8
+	}
+	return c.run(ctx, version, func(cnx *connection, h1 []byte) error {
+		cnx.progress = progress{opts.Progress}
+		return cnx.copyOperation(ctx, h1, r, opts)
+	})
+}
+
+// Paste - Retrieves the content, and writes it to w
+func (c *Client) Paste(ctx context.Context, w io.Writer, opts *PasteOptions) error {
+	item, err := c.fetch(ctx, false, opts)
+	if err != nil {
+		return err
+	}
+	_, err = item.WriteTo(w)
+	return err
+}
+
+// Move - Retrieves the content and deletes it, and writes it to w
+func (c *Client) Move(ctx context.Context, w io.Writer, opts *PasteOptions) error {
+	item, err := c.fetch(ctx, true, opts)
+	if err != nil {
+		return err
+	}
+	_, err = item.WriteTo(w)
+	return err
+}
+
+// Get - Retrieves the content along with its metadata
+func (c *Client) Get(ctx context.Context, opts *PasteOptions) (*Item, error) {
+	return c.fetch(ctx, false, opts)
+}
+
+func (c *Client) fetch(ctx context.Context, isMove bool, opts *PasteOptions) (*Item, error) {
+	if opts == nil {
+		opts = &PasteOptions{}
+	}
+	version := byte(6)
+	if opts.Wait > 0 {
+		version = 7
+	}
+	var item *Item
+	err := c.run(ctx, version, func(cnx *connection, h1 []byte) error {
+		cnx.progress = progress{opts.Progress}
+		var err error
+		if opts.Wait > 0 {
+			item, err = cnx.waitPasteOperation(h1, isMove, opts.Wait)
+		} else {
+			item, err = cnx.pasteOperation(h1, isMove)
+		}
+		return err
+	})
+	return item, err
+}
+
+// Watch - Receives every new clipboard item as it is stored, and passes it to
+// handler, until the connection fails, ctx is canceled or handler returns an
+// error
+func (c *Client) Watch(ctx context.Context, handler func(item *Item) error) error {
+	return c.run(ctx, 7, func(cnx *connection, h1 []byte) error {
+		return cnx.watchOperation(h1, handler)
+	})
+}
+
+// Status - Returns the size and age of the content without retrieving it.
+// The status is also returned along with ErrKeyIDMismatch and ErrTooOld.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status *Status
+	err := c.run(ctx, 7, func(cnx *connection, h1 []byte) error {
+		var err error
+		status, err = cnx.statusOperation(h1)
+		return err
+	})
+	return status, err
+}
+
+// Clear - Deletes the content
+func (c *Client) Clear(ctx context.Context) error {
+	return c.run(ctx, 7, func(cnx *connection, h1 []byte) error {
+		return cnx.clearOperation(h1)
+	})
+}
+
+func (cnx *connection) copyOperation(ctx context.Context, h1 []byte, input io.Reader, opts *CopyOptions) error {
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, uint64(time.Now().Unix()))
+
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+
+	content, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	metadata := newMetadata(opts.Name, opts.MIMEType, input, content, int64(len(content)))
+	if algo := chooseCompression(conf.Compression, metadata.MIMEType, content[:min(len(content), compressionSample)]); algo != CompressionNone {
+		compressed, err := compressBytes(algo, content)
+		if err != nil {
+			return err
+		}
+		if conf.Compression != "auto" || len(compressed) < len(content) {
+			content, metadata.Compression = compressed, algo
+		}
+	}
+	encodedMetadata := metadata.encode()
+
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	contentWithEncryptSkIDAndNonce := make([]byte, 0, 8+24+len(encodedMetadata)+len(content))
+	contentWithEncryptSkIDAndNonce = append(contentWithEncryptSkIDAndNonce, conf.EncryptSkID...)
+	contentWithEncryptSkIDAndNonce = append(contentWithEncryptSkIDAndNonce, nonce...)
+	contentWithEncryptSkIDAndNonce = append(contentWithEncryptSkIDAndNonce, encodedMetadata...)
+	contentWithEncryptSkIDAndNonce = append(contentWithEncryptSkIDAndNonce, content...)
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(conf.EncryptSk, nonce)
+	if err != nil {
+		return err
+	}
+	opcode := byte('S')
+	cipher.XORKeyStream(contentWithEncryptSkIDAndNonce[8+24:], contentWithEncryptSkIDAndNonce[8+24:])
+	signature := ed25519.Sign(conf.SignSk, contentWithEncryptSkIDAndNonce)
+	cnx.progress.begin()
+	cnx.progress.setTotal(uint64(len(contentWithEncryptSkIDAndNonce)))
+
+	if opts.Retries > 0 {
+		uploadID := make([]byte, protocol.UploadIDLen)
+		return cnx.withRetries(ctx, h1, opts.Retries, func(cnx *connection, h1 []byte) error {
+			return cnx.uploadOperation(h1, uploadID, ts, signature, contentWithEncryptSkIDAndNonce)
+		})
+	}
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	h2 := protocol.Auth2Store(conf.Psk, cnx.version, h1, opcode, ts, signature)
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	ciphertextWithEncryptSkIDAndNonceLen := uint64(len(contentWithEncryptSkIDAndNonce))
+	binary.Write(writer, binary.LittleEndian, ciphertextWithEncryptSkIDAndNonceLen)
+	writer.Write(ts)
+	writer.Write(signature)
+	cnx.progress.writer(writer).Write(contentWithEncryptSkIDAndNonce)
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	rbuf := make([]byte, 32)
+	if _, err = io.ReadFull(reader, rbuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrIncompatibleVersion
+		}
+		return err
+	}
+	h3 := rbuf
+	wh3 := protocol.Auth3Store(conf.Psk, h2)
+	if subtle.ConstantTimeCompare(wh3, h3) != 1 {
+		return errIncorrectAuthCode
+	}
+	cnx.progress.add(0, 1)
+	return nil
+}
+
+// uploadOperation - Stores content using a resumable upload. uploadID is all
+// zeros for a new upload, and is set to the identifier assigned by the server.
+func (cnx *connection) uploadOperation(h1 []byte, uploadID []byte, ts []byte, signature []byte,
+	contentWithEncryptSkIDAndNonce []byte,
+) error {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	opcode := byte('U')
+	contentLen := binary.LittleEndian.AppendUint64(nil, uint64(len(contentWithEncryptSkIDAndNonce)))
+	h2 := protocol.Auth2Upload(conf.Psk, cnx.version, h1, opcode, uploadID, contentLen, ts, signature)
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	writer.Write(uploadID)
+	writer.Write(contentLen)
+	writer.Write(ts)
+	writer.Write(signature)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	rbuf := make([]byte, 1+protocol.UploadIDLen+8)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		return fmt.Errorf("Upload interrupted: %w", err)
+	}
+	switch rbuf[0] {
+	case 0x01:
+	case 0x00:
+		return errors.New("The interrupted upload can't be resumed - it has expired")
+	case 0x02:
+		return errors.New("Too many uploads are in progress - try again later")
+	case 0x03:
+		return errors.New("The content is too large for the server")
+	default:
+		return errors.New("Server rejected the upload")
+	}
+	copy(uploadID, rbuf[1:1+protocol.UploadIDLen])
+	received := binary.LittleEndian.Uint64(rbuf[1+protocol.UploadIDLen:])
+	if received > uint64(len(contentWithEncryptSkIDAndNonce)) {
+		return errors.New("Invalid upload offset")
+	}
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	cnx.progress.restart(received)
+	cnx.progress.writer(writer).Write(contentWithEncryptSkIDAndNonce[received:])
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("Upload interrupted: %w", err)
+	}
+	h3 := make([]byte, 32)
+	if _, err := io.ReadFull(reader, h3); err != nil {
+		return fmt.Errorf("Upload interrupted: %w", err)
+	}
+	wh3 := protocol.Auth3Store(conf.Psk, h2)
+	if subtle.ConstantTimeCompare(wh3, h3) != 1 {
+		return errIncorrectAuthCode
+	}
+	cnx.progress.add(0, 1)
+	return nil
+}
+
+func (cnx *connection) pasteOperation(h1 []byte, isMove bool) (*Item, error) {
+	conf, writer := cnx.conf, cnx.writer
+	opcode := byte('G')
+	if isMove {
+		opcode = byte('M')
+	}
+	h2 := protocol.Auth2Get(conf.Psk, cnx.version, h1, opcode)
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	_, item, err := cnx.receiveContent(h2, 0)
+	return item, err
+}
+
+func (cnx *connection) waitPasteOperation(h1 []byte, isMove bool, wait time.Duration) (*Item, error) {
+	conf, writer := cnx.conf, cnx.writer
+	opcode := byte('N')
+	flags := byte(0)
+	if isMove {
+		flags |= protocol.WaitFlagMove
+	}
+	timeout := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timeout, uint64(wait.Round(time.Second)/time.Second))
+	h2 := protocol.Auth2Wait(conf.Psk, cnx.version, h1, opcode, flags, timeout)
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	writer.WriteByte(flags)
+	writer.Write(timeout)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	cnx.conn.SetDeadline(time.Now().Add(wait + conf.Timeout))
+	_, item, err := cnx.receiveContent(h2, wait)
+	return item, err
+}
+
+// receiveContent - Reads, authenticates, verifies and decrypts clipboard
+// content sent by the server. Returns h3 and the content.
+func (cnx *connection) receiveContent(h2 []byte, wait time.Duration) ([]byte, *Item, error) {
+	conf, reader := cnx.conf, cnx.reader
+	rbuf := make([]byte, 112)
+	if nbread, err := io.ReadFull(reader, rbuf); err != nil {
+		if err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		} else if nbread < 80 && wait > 0 {
+			return nil, nil, errorf(ErrEmpty, "No new content was copied within %v", wait)
+		} else if nbread < 80 {
+			return nil, nil, ErrEmpty
+		}
+		return nil, nil, ErrIncompatibleVersion
+	}
+	h3 := rbuf[0:32]
+	ciphertextWithEncryptSkIDAndNonceLen := binary.LittleEndian.Uint64(rbuf[32:40])
+	ts := rbuf[40:48]
+	signature := rbuf[48:112]
+	wh3 := protocol.Auth3Get(conf.Psk, cnx.version, h2, ts, signature)
+	if subtle.ConstantTimeCompare(wh3, h3) != 1 {
+		return nil, nil, errIncorrectAuthCode
+	}
+	storedAt := time.Unix(int64(binary.LittleEndian.Uint64(ts)), 0)
+	if time.Since(storedAt) >= conf.TTL {
+		return nil, nil, ErrTooOld
+	}
+	if ciphertextWithEncryptSkIDAndNonceLen < 8+24 {
+		return nil, nil, errors.New("Clipboard content is too short")
+	}
+	ciphertextWithEncryptSkIDAndNonce := make([]byte, ciphertextWithEncryptSkIDAndNonceLen)
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	cnx.progress.begin()
+	cnx.progress.setTotal(ciphertextWithEncryptSkIDAndNonceLen)
+	if _, err := io.ReadFull(cnx.progress.reader(reader), ciphertextWithEncryptSkIDAndNonce); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrIncompatibleVersion
+		}
+		return nil, nil, err
+	}
+	cnx.progress.add(0, 1)
+	encryptSkID := ciphertextWithEncryptSkIDAndNonce[0:8]
+	if !bytes.Equal(conf.EncryptSkID, encryptSkID) {
+		return nil, nil, keyIDMismatch(conf, "content", encryptSkID)
+	}
+	if !ed25519.Verify(conf.SignPk, ciphertextWithEncryptSkIDAndNonce, signature) {
+		return nil, nil, ErrBadSignature
+	}
+	nonce := ciphertextWithEncryptSkIDAndNonce[8:32]
+	cipher, err := chacha20.NewUnauthenticatedCipher(conf.EncryptSk, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext := ciphertextWithEncryptSkIDAndNonce[32:]
+	cipher.XORKeyStream(plaintext, plaintext)
+	metadata, content, err := splitMetadata(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h3, &Item{
+		Metadata:            metadata,
+		StoredAt:            storedAt,
+		Content:             content,
+		maxDecompressedSize: conf.MaxDecompressedSize,
+	}, nil
+}
+
+func (cnx *connection) watchOperation(h1 []byte, handler func(item *Item) error) error {
+	conf, writer := cnx.conf, cnx.writer
+	opcode := byte('W')
+	h2 := protocol.Auth2Get(conf.Psk, cnx.version, h1, opcode)
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	for {
+		cnx.conn.SetDeadline(time.Time{})
+		h3, item, err := cnx.receiveContent(h2, 0)
+		if err != nil {
+			return err
+		}
+		h2 = h3
+		if err := handler(item); err != nil {
+			return err
+		}
+	}
+}
+
+func (cnx *connection) statusOperation(h1 []byte) (*Status, error) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	opcode := byte('I')
+	h2 := protocol.Auth2Get(conf.Psk, cnx.version, h1, opcode)
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	rbuf := make([]byte, 120)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, ErrIncompatibleVersion
+		}
+		return nil, err
+	}
+	h3 := rbuf[0:32]
+	ts, contentLenBytes, encryptSkID, signature := rbuf[32:40], rbuf[40:48], rbuf[48:56], rbuf[56:120]
+	wh3 := protocol.Auth3Info(conf.Psk, h2, ts, contentLenBytes, encryptSkID, signature)
+	if subtle.ConstantTimeCompare(wh3, h3) != 1 {
+		return nil, errIncorrectAuthCode
+	}
+	contentLen := binary.LittleEndian.Uint64(contentLenBytes)
+	if contentLen == 0 {
+		return nil, errorf(ErrEmpty, "The clipboard is empty")
+	}
+	status := &Status{
+		StoredSize: contentLen - min(contentLen, 8+24),
+		StoredAt:   time.Unix(int64(binary.LittleEndian.Uint64(ts)), 0),
+		KeyID:      binary.LittleEndian.Uint64(encryptSkID),
+		Digest:     bytes.Clone(signature[0:8]),
+	}
+	if !bytes.Equal(conf.EncryptSkID, encryptSkID) {
+		return status, keyIDMismatch(conf, "content", encryptSkID)
+	}
+	if time.Since(status.StoredAt) >= conf.TTL {
+		return status, ErrTooOld
+	}
+	return status, nil
+}
+
+func (cnx *connection) clearOperation(h1 []byte) error {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	opcode := byte('D')
+	h2 := protocol.Auth2Get(conf.Psk, cnx.version, h1, opcode)
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	rbuf := make([]byte, 32)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return ErrIncompatibleVersion
+		}
+		return err
+	}
+	h3 := rbuf
+	wh3 := protocol.Auth3Store(conf.Psk, h2)
+	if subtle.ConstantTimeCompare(wh3, h3) != 1 {
+		return errIncorrectAuthCode
+	}
+	return nil
+}
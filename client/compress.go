@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = byte(0)
+	CompressionGzip = byte(1)
+	CompressionZstd = byte(2)
+
+	DefaultMaxDecompressedSize = int64(10 * 1024 * 1024 * 1024)
+
+	minCompressibleLen = 128
+	compressionSample  = 64 * 1024 // bytes compressed to decide in auto mode
+	maxZstdWindow      = 64 * 1024 * 1024
+)
+
+var incompressibleMIMETypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-xz",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"audio/",
+	"video/",
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"image/webp",
+	"font/woff",
+	"font/woff2",
+}
+
+// CompressionName - Name of a compression algorithm
+func CompressionName(algo byte) string {
+	switch algo {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown (%v)", algo)
+	}
+}
+
+// ValidCompressionMode - Whether a compression mode is supported
+func ValidCompressionMode(mode string) bool {
+	switch mode {
+	case "none", "gzip", "zstd", "auto":
+		return true
+	}
+	return false
+}
+
+func isIncompressibleMIMEType(mimeType string) bool {
+	for _, prefix := range incompressibleMIMETypes {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseCompression - Returns the algorithm to use for a compression mode.
+// In auto mode, content that doesn't compress well, judging from its type and
+// from a sample, is left uncompressed.
+func chooseCompression(mode string, mimeType string, sample []byte) byte {
+	switch mode {
+	case "gzip":
+		return CompressionGzip
+	case "zstd":
+		return CompressionZstd
+	case "auto":
+		if len(sample) < minCompressibleLen || isIncompressibleMIMEType(mimeType) {
+			return CompressionNone
+		}
+		compressed, err := compressBytes(CompressionZstd, sample)
+		if err != nil || len(compressed) > len(sample)*9/10 {
+			return CompressionNone
+		}
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+func newCompressWriter(algo byte, w io.Writer) (io.WriteCloser, error) {
+	switch algo {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("Unsupported compression algorithm: %v", CompressionName(algo))
+}
+
+func newDecompressReader(algo byte, r io.Reader) (io.ReadCloser, error) {
+	switch algo {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("Unsupported compression algorithm: %v", CompressionName(algo))
+}
+
+func compressBytes(algo byte, content []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	w, err := newCompressWriter(algo, &compressed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// decompressTo - Decompresses r into w, failing if the output is larger than
+// maxSize, or doesn't match the expected size if it is known (>= 0)
+func decompressTo(algo byte, w io.Writer, r io.Reader, maxSize int64, expectedSize int64) error {
+	if expectedSize >= 0 && expectedSize < maxSize {
+		maxSize = expectedSize
+	}
+	decoder, err := newDecompressReader(algo, r)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	written, err := io.Copy(w, io.LimitReader(decoder, maxSize))
+	if err != nil {
+		return err
+	}
+	if n, _ := decoder.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("Decompressed content exceeds the maximum size (%v bytes)", maxSize)
+	}
+	if expectedSize >= 0 && written != expectedSize {
+		return fmt.Errorf("Decompressed content size mismatch (%v bytes, expected %v)", written, expectedSize)
+	}
+	return nil
+}
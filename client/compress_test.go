@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+const bombSize = 256 * 1024 * 1024
+
+// bomb - A small compressed stream that expands to bombSize zeros
+func bomb(t *testing.T, algo byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	w, err := newCompressWriter(algo, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(w, zeroReader{}, bombSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// limitedWriter - Discards what is written, failing past max bytes
+type limitedWriter struct {
+	t   *testing.T
+	n   int64
+	max int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	lw.n += int64(len(p))
+	if lw.n > lw.max {
+		lw.t.Fatalf("%v bytes written, past the %v bytes limit", lw.n, lw.max)
+	}
+	return len(p), nil
+}
+
+func TestDecompressionBomb(t *testing.T) {
+	const maxSize = 1024 * 1024
+	for _, algo := range []byte{CompressionGzip, CompressionZstd} {
+		compressed := bomb(t, algo)
+		if len(compressed) > bombSize/100 {
+			t.Fatalf("%v: the bomb is %v bytes long", CompressionName(algo), len(compressed))
+		}
+		tests := []struct {
+			name         string
+			expectedSize int64
+		}{
+			{"unknown size", -1},
+			{"actual size", bombSize},
+			{"understated size", 1000},
+		}
+		for _, test := range tests {
+			w := &limitedWriter{t: t, max: maxSize}
+			err := decompressTo(algo, w, bytes.NewReader(compressed), maxSize, test.expectedSize)
+			if err == nil || !strings.Contains(err.Error(), "exceeds the maximum size") {
+				t.Errorf("%v, %v: decompressTo() = %v, want the content to be rejected",
+					CompressionName(algo), test.name, err)
+			}
+		}
+	}
+}
+
+func TestDecompressSizeMismatch(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible "), 1000)
+	for _, algo := range []byte{CompressionGzip, CompressionZstd} {
+		compressed, err := compressBytes(algo, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := decompressTo(algo, &out, bytes.NewReader(compressed), 1<<20, int64(len(content))); err != nil ||
+			!bytes.Equal(out.Bytes(), content) {
+			t.Fatalf("%v: decompressTo() = %v", CompressionName(algo), err)
+		}
+		err = decompressTo(algo, io.Discard, bytes.NewReader(compressed), 1<<20, int64(len(content))+1)
+		if err == nil || !strings.Contains(err.Error(), "size mismatch") {
+			t.Fatalf("%v: decompressTo() = %v, want a size mismatch", CompressionName(algo), err)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/ed25519"
+)
+
+// A live stream is relayed to the pullers that are connected at the time,
+// that can join and leave at any time and receive the messages pushed from
+// then on. Pullers can also send input back to the pusher, sealed with a key
+// specific to each of them. The end of the stream is signed, along with the
+// number of messages.
+
+// LiveStream - A live stream being pushed
+type LiveStream struct {
+	cnx         *connection
+	cidBytes    []byte
+	header      []byte
+	aead        cipher.AEAD
+	attachers   map[string]*liveAttacher
+	mu          sync.Mutex
+	chunkIndex  uint64
+	closeOnce   sync.Once
+	closeResult error
+}
+
+// liveAttacher - State of a puller sending input to a live stream. A puller
+// whose inputs were lost or reordered is closed, and ignored from then on.
+type liveAttacher struct {
+	aead      cipher.AEAD
+	nextIndex uint64
+	closed    bool
+}
+
+// LiveSubscription - A live stream being pulled
+type LiveSubscription struct {
+	cnx              *connection
+	header           []byte
+	aead             cipher.AEAD
+	chunkIndex       uint64
+	inputNoncePrefix []byte
+	inputAEAD        cipher.AEAD
+	mu               sync.Mutex
+	inputIndex       uint64
+}
+
+// PushLive - Starts a live stream. The stream is aborted if ctx is canceled.
+func (c *Client) PushLive(ctx context.Context, cid string) (*LiveStream, error) {
+	cnx, h1, err := c.connect(ctx, 8)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := cnx.pushLiveOperation(h1, cid)
+	if err != nil {
+		cnx.close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (cnx *connection) pushLiveOperation(h1 []byte, cid string) (*LiveStream, error) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	if err := cnx.sendStreamRequest(h1, byte('P'), &protocol.StreamOptions{
+		Channel: protocol.DeriveChannelID(conf.EncryptSk, []byte(cid)),
+		Live:    true,
+	}); err != nil {
+		return nil, err
+	}
+	cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+	statusBuf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, statusBuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrIncompatibleVersion
+		}
+		return nil, err
+	}
+	switch statusBuf[0] {
+	case 0x01:
+	case 0x02:
+		return nil, errors.New("Another push is already active")
+	default:
+		return nil, errors.New("Server rejected the stream")
+	}
+	cnx.conn.SetDeadline(time.Time{})
+
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint64(header[0:8], uint64(time.Now().Unix()))
+	copy(header[8:16], conf.EncryptSkID)
+	if _, err := rand.Read(header[16:32]); err != nil {
+		return nil, err
+	}
+	cidBytes := []byte(cid)
+	aead, err := chacha20poly1305.NewX(protocol.DeriveStreamKey(conf.EncryptSk, header[0:8], conf.EncryptSkID,
+		header[16:32], cidBytes))
+	if err != nil {
+		return nil, err
+	}
+	writer.Write(header)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return &LiveStream{
+		cnx:       cnx,
+		cidBytes:  cidBytes,
+		header:    header,
+		aead:      aead,
+		attachers: make(map[string]*liveAttacher),
+	}, nil
+}
+
+// Send - Sends a message, of at most protocol.MaxChunk bytes, to the pullers
+func (stream *LiveStream) Send(message []byte) error {
+	if len(message) > protocol.MaxChunk {
+		return errors.New("Live stream: message too large")
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	writer := stream.cnx.writer
+	binary.Write(writer, binary.LittleEndian, uint32(len(message)))
+	writer.Write(stream.aead.Seal(nil, protocol.DeriveChunkNonce(stream.header[16:32], stream.chunkIndex), message, nil))
+	stream.chunkIndex++
+	return writer.Flush()
+}
+
+// ReadInput - Waits for the next input sent by a puller. Returns an empty
+// input when a puller joins. Inputs that can't be authenticated are skipped,
+// and so are all inputs from a puller after a gap in its input sequence.
+// Must not be called concurrently.
+func (stream *LiveStream) ReadInput() ([]byte, error) {
+	conf, reader := stream.cnx.conf, stream.cnx.reader
+	ts, noncePrefix := stream.header[0:8], stream.header[16:32]
+	for {
+		var frameLen uint32
+		if err := binary.Read(reader, binary.LittleEndian, &frameLen); err != nil {
+			return nil, err
+		}
+		if frameLen > protocol.MaxLiveInputLen {
+			return nil, errors.New("Live stream: input too large")
+		}
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+		if frameLen == 0 {
+			return []byte{}, nil
+		}
+		if frameLen < 16+8+16 {
+			continue
+		}
+		attacherNoncePrefix, sealed := frame[0:16], frame[24:]
+		index := binary.LittleEndian.Uint64(frame[16:24])
+		att := stream.attachers[string(attacherNoncePrefix)]
+		if att == nil {
+			inputAEAD, err := chacha20poly1305.NewX(protocol.DeriveTunnelKey(conf.EncryptSk, ts, conf.EncryptSkID,
+				attacherNoncePrefix, noncePrefix, stream.cidBytes))
+			if err != nil {
+				continue
+			}
+			att = &liveAttacher{aead: inputAEAD}
+		}
+		if att.closed {
+			continue
+		}
+		plain, err := att.aead.Open(nil, protocol.DeriveChunkNonce(attacherNoncePrefix, index), sealed, nil)
+		if err != nil {
+			continue
+		}
+		stream.attachers[string(attacherNoncePrefix)] = att
+		if index != att.nextIndex {
+			att.closed = true
+			continue
+		}
+		att.nextIndex++
+		if len(plain) > 0 {
+			return plain, nil
+		}
+	}
+}
+
+// Close - Signs the end of the stream, and closes the connection
+func (stream *LiveStream) Close() error {
+	stream.closeOnce.Do(func() {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		cnx := stream.cnx
+		defer cnx.close()
+		signature := ed25519.Sign(cnx.conf.SignSk, protocol.LiveStreamEndDigest(stream.header, stream.chunkIndex))
+		cnx.writer.Write(make([]byte, 4))
+		cnx.writer.Write(signature)
+		stream.closeResult = cnx.writer.Flush()
+	})
+	return stream.closeResult
+}
+
+// PullLive - Joins a live stream. The subscription is closed if ctx is
+// canceled.
+func (c *Client) PullLive(ctx context.Context, cid string) (*LiveSubscription, error) {
+	cnx, h1, err := c.connect(ctx, 8)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := cnx.pullLiveOperation(h1, cid)
+	if err != nil {
+		cnx.close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (cnx *connection) pullLiveOperation(h1 []byte, cid string) (*LiveSubscription, error) {
+	conf, reader := cnx.conf, cnx.reader
+	if err := cnx.sendStreamRequest(h1, byte('L'), &protocol.StreamOptions{
+		Channel: protocol.DeriveChannelID(conf.EncryptSk, []byte(cid)),
+		Live:    true,
+	}); err != nil {
+		return nil, err
+	}
+	cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+	statusBuf := make([]byte, 1)
+	if _, err := io.ReadFull(reader, statusBuf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, ErrIncompatibleVersion
+		}
+		return nil, err
+	}
+	switch statusBuf[0] {
+	case 0x01:
+	case 0x02:
+		return nil, errors.New("Too many clients are already attached")
+	case 0x05:
+		return nil, ErrNoLiveStream
+	default:
+		return nil, errors.New("Server rejected the request")
+	}
+	header := make([]byte, 32+8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	cnx.conn.SetDeadline(time.Time{})
+	chunkIndex := binary.LittleEndian.Uint64(header[32:])
+	header = header[:32]
+	if err := checkStreamHeader(conf, header); err != nil {
+		return nil, err
+	}
+	cidBytes := []byte(cid)
+	ts, noncePrefix := header[0:8], header[16:32]
+	aead, err := chacha20poly1305.NewX(protocol.DeriveStreamKey(conf.EncryptSk, ts, conf.EncryptSkID, noncePrefix, cidBytes))
+	if err != nil {
+		return nil, err
+	}
+	inputNoncePrefix := make([]byte, 16)
+	if _, err := rand.Read(inputNoncePrefix); err != nil {
+		return nil, err
+	}
+	inputAEAD, err := chacha20poly1305.NewX(protocol.DeriveTunnelKey(conf.EncryptSk, ts, conf.EncryptSkID,
+		inputNoncePrefix, noncePrefix, cidBytes))
+	if err != nil {
+		return nil, err
+	}
+	return &LiveSubscription{
+		cnx:              cnx,
+		header:           header,
+		aead:             aead,
+		chunkIndex:       chunkIndex,
+		inputNoncePrefix: inputNoncePrefix,
+		inputAEAD:        inputAEAD,
+	}, nil
+}
+
+// Receive - Waits for the next message. Returns io.EOF once the stream has
+// ended and its end has been verified. Must not be called concurrently.
+func (sub *LiveSubscription) Receive() ([]byte, error) {
+	conf, reader := sub.cnx.conf, sub.cnx.reader
+	var chunkLen uint32
+	if err := binary.Read(reader, binary.LittleEndian, &chunkLen); err != nil {
+		return nil, fmt.Errorf("Live stream: connection lost: %w", err)
+	}
+	if chunkLen == protocol.StreamDroppedMarker {
+		return nil, errors.New("Live stream: dropped by the server for being too slow")
+	}
+	if chunkLen == 0 {
+		signature := make([]byte, 64)
+		if _, err := io.ReadFull(reader, signature); err != nil {
+			return nil, fmt.Errorf("Live stream: connection lost: %w", err)
+		}
+		if !ed25519.Verify(conf.SignPk, protocol.LiveStreamEndDigest(sub.header, sub.chunkIndex), signature) {
+			return nil, errorf(ErrBadSignature, "Live stream: signature verification failed")
+		}
+		return nil, io.EOF
+	}
+	if chunkLen > protocol.MaxChunk {
+		return nil, fmt.Errorf("Live stream: chunk too large (%v > %v)", chunkLen, protocol.MaxChunk)
+	}
+	sealed := make([]byte, int(chunkLen)+16)
+	if _, err := io.ReadFull(reader, sealed); err != nil {
+		return nil, fmt.Errorf("Live stream: connection lost: %w", err)
+	}
+	plain, err := sub.aead.Open(nil, protocol.DeriveChunkNonce(sub.header[16:32], sub.chunkIndex), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Live stream: AEAD authentication failed for chunk %v", sub.chunkIndex)
+	}
+	sub.chunkIndex++
+	return plain, nil
+}
+
+// SendInput - Sends input to the pusher, that may ignore it
+func (sub *LiveSubscription) SendInput(input []byte) error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	writer := sub.cnx.writer
+	sealed := sub.inputAEAD.Seal(nil, protocol.DeriveChunkNonce(sub.inputNoncePrefix, sub.inputIndex), input, nil)
+	frame := binary.LittleEndian.AppendUint64(bytes.Clone(sub.inputNoncePrefix), sub.inputIndex)
+	frame = append(frame, sealed...)
+	binary.Write(writer, binary.LittleEndian, uint32(len(frame)))
+	writer.Write(frame)
+	sub.inputIndex++
+	return writer.Flush()
+}
+
+// Close - Leaves the stream
+func (sub *LiveSubscription) Close() error {
+	sub.cnx.close()
+	return nil
+}
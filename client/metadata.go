@@ -0,0 +1,157 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The metadata block is the first thing in the plaintext, so that it is
+// encrypted and covered by the signature along with the content itself.
+//
+// metadata := metadataMagic || uint32_le(len(body)) || body
+// body     := (tag(1) || uint16_le(len(value)) || value)*
+
+var metadataMagic = []byte{0x8a, 'P', 'K', 'M', 'D', '\r', '\n', 0x1a}
+
+const (
+	metaTagName     = byte(0x01)
+	metaTagMIMEType = byte(0x02)
+	metaTagSize     = byte(0x03)
+	metaTagMode     = byte(0x04)
+	metaTagHostname = byte(0x05)
+	metaTagCompress = byte(0x06)
+
+	maxMetadataLen = 65536
+	sniffLen       = 512
+)
+
+// statter - An input that can tell its size and permissions, like *os.File
+type statter interface {
+	Stat() (os.FileInfo, error)
+}
+
+// Metadata - Information about the content, sent encrypted along with it
+type Metadata struct {
+	Name        string
+	MIMEType    string
+	Size        int64
+	Mode        os.FileMode
+	Hostname    string
+	Compression byte
+}
+
+func newMetadata(name string, mimeType string, input io.Reader, sample []byte, size int64) *Metadata {
+	metadata := &Metadata{MIMEType: mimeType, Size: size}
+	if name != "" {
+		metadata.Name = filepath.Base(name)
+	}
+	if file, ok := input.(statter); ok {
+		if fi, err := file.Stat(); err == nil && fi.Mode().IsRegular() {
+			metadata.Mode = fi.Mode().Perm()
+			if metadata.Size < 0 {
+				metadata.Size = fi.Size()
+			}
+		}
+	}
+	if metadata.MIMEType == "" && metadata.Name != "" {
+		metadata.MIMEType = mime.TypeByExtension(filepath.Ext(metadata.Name))
+	}
+	if metadata.MIMEType == "" && len(sample) > 0 {
+		metadata.MIMEType = http.DetectContentType(sample[:min(len(sample), sniffLen)])
+	}
+	metadata.Hostname, _ = os.Hostname()
+	return metadata
+}
+
+func (metadata *Metadata) encode() []byte {
+	var body bytes.Buffer
+	writeTag := func(tag byte, value []byte) {
+		body.WriteByte(tag)
+		binary.Write(&body, binary.LittleEndian, uint16(len(value)))
+		body.Write(value)
+	}
+	truncated := func(s string) []byte {
+		return []byte(s[:min(len(s), 1024)])
+	}
+	if metadata.Name != "" {
+		writeTag(metaTagName, truncated(metadata.Name))
+	}
+	if metadata.MIMEType != "" {
+		writeTag(metaTagMIMEType, truncated(metadata.MIMEType))
+	}
+	if metadata.Size >= 0 {
+		writeTag(metaTagSize, binary.LittleEndian.AppendUint64(nil, uint64(metadata.Size)))
+	}
+	if metadata.Mode != 0 {
+		writeTag(metaTagMode, binary.LittleEndian.AppendUint32(nil, uint32(metadata.Mode)))
+	}
+	if metadata.Hostname != "" {
+		writeTag(metaTagHostname, truncated(metadata.Hostname))
+	}
+	if metadata.Compression != CompressionNone {
+		writeTag(metaTagCompress, []byte{metadata.Compression})
+	}
+	encoded := make([]byte, 0, len(metadataMagic)+4+body.Len())
+	encoded = append(encoded, metadataMagic...)
+	encoded = binary.LittleEndian.AppendUint32(encoded, uint32(body.Len()))
+	return append(encoded, body.Bytes()...)
+}
+
+// splitMetadata - Returns the metadata and the content following it, or nil
+// metadata if the plaintext doesn't start with a metadata block
+func splitMetadata(plaintext []byte) (*Metadata, []byte, error) {
+	if !bytes.HasPrefix(plaintext, metadataMagic) {
+		return nil, plaintext, nil
+	}
+	rest := plaintext[len(metadataMagic):]
+	if len(rest) < 4 {
+		return nil, nil, errors.New("Truncated metadata")
+	}
+	bodyLen := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	if bodyLen > maxMetadataLen || uint64(bodyLen) > uint64(len(rest)) {
+		return nil, nil, errors.New("Invalid metadata length")
+	}
+	body, content := rest[:bodyLen], rest[bodyLen:]
+	metadata := &Metadata{Size: -1}
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, nil, errors.New("Truncated metadata")
+		}
+		tag, valueLen := body[0], int(binary.LittleEndian.Uint16(body[1:3]))
+		body = body[3:]
+		if valueLen > len(body) {
+			return nil, nil, errors.New("Truncated metadata")
+		}
+		value := body[:valueLen]
+		body = body[valueLen:]
+		switch tag {
+		case metaTagName:
+			metadata.Name = filepath.Base(string(value))
+		case metaTagMIMEType:
+			metadata.MIMEType = string(value)
+		case metaTagSize:
+			if len(value) == 8 {
+				metadata.Size = int64(binary.LittleEndian.Uint64(value))
+			}
+		case metaTagMode:
+			if len(value) == 4 {
+				metadata.Mode = os.FileMode(binary.LittleEndian.Uint32(value)).Perm()
+			}
+		case metaTagHostname:
+			metadata.Hostname = string(value)
+		case metaTagCompress:
+			if len(value) != 1 {
+				return nil, nil, errors.New("Invalid compression metadata")
+			}
+			metadata.Compression = value[0]
+		}
+	}
+	return metadata, content, nil
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	tests := []Metadata{
+		{Size: -1},
+		{Name: "notes.txt", MIMEType: "text/plain; charset=utf-8", Size: 42, Mode: 0o640, Hostname: "host"},
+		{Name: "archive.tar", Size: 0, Compression: CompressionZstd},
+		{MIMEType: "application/octet-stream", Size: 1 << 40, Compression: CompressionGzip},
+	}
+	content := []byte("the content itself")
+	for _, metadata := range tests {
+		plaintext := append(metadata.encode(), content...)
+		decoded, rest, err := splitMetadata(plaintext)
+		if err != nil {
+			t.Fatalf("splitMetadata(%+v): %v", metadata, err)
+		}
+		if decoded == nil || !reflect.DeepEqual(*decoded, metadata) {
+			t.Fatalf("splitMetadata() = %+v, want %+v", decoded, metadata)
+		}
+		if !bytes.Equal(rest, content) {
+			t.Fatalf("splitMetadata() content = %q, want %q", rest, content)
+		}
+	}
+}
+
+func TestMetadataTruncatesLongValues(t *testing.T) {
+	metadata := Metadata{Name: strings.Repeat("n", 5000), Size: -1}
+	decoded, _, err := splitMetadata(metadata.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Name) != 1024 {
+		t.Fatalf("name length = %v, want 1024", len(decoded.Name))
+	}
+}
+
+func TestSplitMetadataWithoutMetadata(t *testing.T) {
+	for _, plaintext := range [][]byte{nil, []byte("plain content"), metadataMagic[:4]} {
+		metadata, content, err := splitMetadata(plaintext)
+		if err != nil || metadata != nil || !bytes.Equal(content, plaintext) {
+			t.Fatalf("splitMetadata(%q) = %v, %q, %v", plaintext, metadata, content, err)
+		}
+	}
+}
+
+// rawMetadata - Encodes a metadata block with the given body
+func rawMetadata(body ...byte) []byte {
+	encoded := binary.LittleEndian.AppendUint32(bytes.Clone(metadataMagic), uint32(len(body)))
+	return append(encoded, body...)
+}
+
+func TestSplitMetadataSanitizes(t *testing.T) {
+	name := "../../etc/passwd"
+	body := append([]byte{metaTagName, byte(len(name)), 0}, name...)
+	body = append(body, metaTagMode, 4, 0)
+	body = binary.LittleEndian.AppendUint32(body, 0o4777)
+	body = append(body, 0xee, 1, 0, 0xff)
+	metadata, _, err := splitMetadata(rawMetadata(body...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Name != "passwd" {
+		t.Fatalf("name = %q, want %q", metadata.Name, "passwd")
+	}
+	if metadata.Mode != 0o777 {
+		t.Fatalf("mode = %o, want 777", metadata.Mode)
+	}
+	if metadata.Size != -1 {
+		t.Fatalf("size = %v, want -1", metadata.Size)
+	}
+}
+
+func TestSplitMetadataInvalid(t *testing.T) {
+	tooLong := binary.LittleEndian.AppendUint32(bytes.Clone(metadataMagic), maxMetadataLen+1)
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"no length", metadataMagic},
+		{"length past the end", rawMetadata(metaTagName, 1, 0, 'x')[:len(metadataMagic)+4+2]},
+		{"length too large", append(tooLong, make([]byte, maxMetadataLen+1)...)},
+		{"truncated tag", rawMetadata(metaTagName, 1)},
+		{"truncated value", rawMetadata(metaTagName, 5, 0, 'x')},
+		{"compression", rawMetadata(metaTagCompress, 2, 0, 1, 1)},
+	}
+	for _, test := range tests {
+		if metadata, _, err := splitMetadata(test.plaintext); err == nil {
+			t.Errorf("%v: splitMetadata() = %+v, want an error", test.name, metadata)
+		}
+	}
+}
+
+// wrappedFile - An input that isn't an *os.File, but has a Stat method
+type wrappedFile struct {
+	*os.File
+}
+
+func TestNewMetadataStat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(path, make([]byte, 1234), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, input := range []io.Reader{file, wrappedFile{file}} {
+		metadata := newMetadata("", "", input, nil, -1)
+		if metadata.Size != 1234 || metadata.Mode != 0o640 {
+			t.Fatalf("newMetadata() = %+v, want the size and mode of the file", metadata)
+		}
+	}
+	metadata := newMetadata("", "", bytes.NewReader(nil), nil, -1)
+	if metadata.Size != -1 || metadata.Mode != 0 {
+		t.Fatalf("newMetadata() = %+v without a file", metadata)
+	}
+}
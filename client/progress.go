@@ -0,0 +1,98 @@
+package client
+
+import (
+	"io"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+)
+
+// Progress - Receives the amount of data transferred by an operation, as it
+// is transferred. Methods can be called from any goroutine.
+type Progress interface {
+	// Begin - Called once data is about to be exchanged
+	Begin()
+	// SetTotal - Sets the expected number of bytes, if it is known
+	SetTotal(total uint64)
+	// Add - Records transferred bytes and chunks
+	Add(bytes uint64, chunks uint64)
+	// Restart - Sets the number of bytes transferred so far, when a
+	// transfer is resumed
+	Restart(bytes uint64)
+}
+
+// progress - Progress of an operation, that reports nothing if no Progress
+// was given
+type progress struct {
+	p Progress
+}
+
+func (pr progress) begin() {
+	if pr.p != nil {
+		pr.p.Begin()
+	}
+}
+
+func (pr progress) setTotal(total uint64) {
+	if pr.p != nil {
+		pr.p.SetTotal(total)
+	}
+}
+
+func (pr progress) add(bytes uint64, chunks uint64) {
+	if pr.p != nil {
+		pr.p.Add(bytes, chunks)
+	}
+}
+
+func (pr progress) restart(bytes uint64) {
+	if pr.p != nil {
+		pr.p.Restart(bytes)
+	}
+}
+
+// reader - Counts the bytes read from r
+func (pr progress) reader(r io.Reader) io.Reader {
+	if pr.p == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: pr}
+}
+
+// writer - Counts the bytes written to w. Large writes are split, so that the
+// progress keeps being updated while they are sent.
+func (pr progress) writer(w io.Writer) io.Writer {
+	if pr.p == nil {
+		return w
+	}
+	return &progressWriter{w: w, progress: pr}
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress progress
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.progress.add(uint64(n), 0)
+	return n, err
+}
+
+type progressWriter struct {
+	w        io.Writer
+	progress progress
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := pw.w.Write(p[:min(len(p), protocol.MaxChunk)])
+		written += n
+		pw.progress.add(uint64(n), 0)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
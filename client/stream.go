@@ -0,0 +1,665 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/ed25519"
+)
+
+// PushOptions - Options of a stream push
+type PushOptions struct {
+	// CID - Content identifier, that pullers must use as well
+	CID string
+	// Name - File name to record in the metadata
+	Name string
+	// MIMEType - Type to record in the metadata, guessed if empty
+	MIMEType string
+	// WaitPullers - Wait until at least this number of clients are ready
+	// to receive the stream, for up to WaitTimeout. The timeout is sent in
+	// whole seconds, and must be at least one second.
+	WaitPullers uint32
+	WaitTimeout time.Duration
+	// Replay - Let clients that start pulling within this duration receive
+	// the stream from the beginning
+	Replay time.Duration
+	// Store - Let the server store the stream for clients that start
+	// pulling later with PullOptions.Store. Push fails if the server
+	// couldn't store it.
+	Store bool
+	// Ack - Wait until every puller has verified the stream
+	Ack bool
+	// Started - Called with the number of pullers once the server has
+	// accepted the stream
+	Started  func(pullers uint32)
+	Progress Progress
+}
+
+// PullOptions - Options of a stream pull
+type PullOptions struct {
+	// CID - Content identifier used by the pusher
+	CID string
+	// Store - Receive the stream stored by the server, if there is one and
+	// no push is active, instead of waiting for the next push
+	Store bool
+	// Retries - Number of times to reconnect and resume the stream if the
+	// connection is lost
+	Retries uint
+	// Verified - Called once the whole stream has been received and its
+	// signature verified, before the pusher is told. If it returns an error,
+	// the pull fails and the pusher is told that the stream wasn't verified.
+	Verified func() error
+	Progress Progress
+}
+
+// AckStatus - What a puller acknowledged
+type AckStatus int
+
+const (
+	// AckMissing - The puller left without acknowledging the stream
+	AckMissing AckStatus = iota
+	// AckInvalid - The acknowledgement couldn't be authenticated
+	AckInvalid
+	// AckFailed - The puller failed to verify the stream
+	AckFailed
+	// AckVerified - The puller verified the stream
+	AckVerified
+)
+
+// Ack - Acknowledgement of a stream by a puller
+type Ack struct {
+	Hostname string
+	Status   AckStatus
+}
+
+// PushResult - Outcome of a stream push
+type PushResult struct {
+	// Pullers - Number of pullers the stream started with
+	Pullers uint32
+	// Acks - Acknowledgements of the pullers, with PushOptions.Ack
+	Acks []Ack
+	// Left - Number of pullers that left before the end of the stream,
+	// with PushOptions.Ack
+	Left uint32
+}
+
+// Push - Streams the content read from r to the pullers. With opts.Ack, the
+// result is also returned if some pullers didn't verify the stream. Streams
+// require a server supporting protocol version 8, and ErrIncompatibleVersion
+// is returned if the server is older. If r has
+// a Stat method, like *os.File, the size and permissions of a regular file
+// are recorded in the metadata.
+func (c *Client) Push(ctx context.Context, r io.Reader, opts *PushOptions) (*PushResult, error) {
+	if opts == nil {
+		opts = &PushOptions{}
+	}
+	if opts.WaitPullers > 0 && opts.WaitTimeout < time.Second {
+		return nil, errors.New("The timeout to wait for pullers must be at least one second")
+	}
+	var result *PushResult
+	err := c.run(ctx, 8, func(cnx *connection, h1 []byte) error {
+		cnx.progress = progress{opts.Progress}
+		var err error
+		result, err = cnx.pushStreamOperation(h1, r, opts)
+		return err
+	})
+	return result, err
+}
+
+// Pull - Waits for a stream, and writes it to w once its chunks are
+// authenticated. The signature of the whole stream is only verified at the
+// end: w receives data before, and the stream mustn't be trusted unless Pull
+// returns nil. Like Push, Pull requires a server supporting protocol version
+// 8.
+func (c *Client) Pull(ctx context.Context, w io.Writer, opts *PullOptions) error {
+	if opts == nil {
+		opts = &PullOptions{}
+	}
+	return c.run(ctx, 8, func(cnx *connection, h1 []byte) error {
+		cnx.progress = progress{opts.Progress}
+		return cnx.pullStream(ctx, h1, w, opts)
+	})
+}
+
+func (cnx *connection) sendStreamRequest(h1 []byte, opcode byte, opts *protocol.StreamOptions) error {
+	conf, writer := cnx.conf, cnx.writer
+	encodedOpts := opts.Encode()
+	h2 := protocol.Auth2Stream(conf.Psk, cnx.version, h1, opcode, encodedOpts)
+	writer.WriteByte(opcode)
+	writer.Write(h2)
+	writer.Write(encodedOpts)
+	return writer.Flush()
+}
+
+func (cnx *connection) pushStreamOperation(h1 []byte, input io.Reader, opts *PushOptions) (*PushResult, error) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	opcode := byte('P')
+	if err := cnx.sendStreamRequest(h1, opcode, &protocol.StreamOptions{
+		Channel:     protocol.DeriveChannelID(conf.EncryptSk, []byte(opts.CID)),
+		WaitPullers: opts.WaitPullers,
+		WaitTimeout: opts.WaitTimeout,
+		Replay:      opts.Replay,
+		Store:       opts.Store,
+		Ack:         opts.Ack,
+	}); err != nil {
+		return nil, err
+	}
+
+	if opts.WaitPullers > 0 {
+		cnx.conn.SetDeadline(time.Now().Add(opts.WaitTimeout + conf.Timeout))
+	} else {
+		cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+	}
+	statusBuf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, statusBuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrIncompatibleVersion
+		}
+		return nil, err
+	}
+	pullersCount := binary.LittleEndian.Uint32(statusBuf[1:])
+	switch statusBuf[0] {
+	case 0x01:
+		if opts.Started != nil {
+			opts.Started(pullersCount)
+		}
+	case 0x00:
+		if opts.WaitPullers > 0 {
+			return nil, fmt.Errorf("Only %v of the %v expected pullers connected within %v",
+				pullersCount, opts.WaitPullers, opts.WaitTimeout)
+		}
+		return nil, errors.New("No clients are waiting to receive the stream")
+	case 0x02:
+		return nil, errors.New("Another push is already active")
+	case 0x03:
+		return nil, errors.New("The server can't keep more streams for replay - try again later")
+	case 0x04:
+		return nil, errors.New("The server is unable to store the stream")
+	default:
+		return nil, errors.New("Server rejected the stream")
+	}
+	result := &PushResult{Pullers: pullersCount}
+
+	cidBytes := []byte(opts.CID)
+
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, uint64(time.Now().Unix()))
+
+	noncePrefix := make([]byte, 16)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+
+	streamKey := protocol.DeriveStreamKey(conf.EncryptSk, ts, conf.EncryptSkID, noncePrefix, cidBytes)
+	aead, err := chacha20poly1305.NewX(streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cidBind := protocol.ComputeCIDBind(conf.EncryptSk, cidBytes)
+	transcript := protocol.NewTranscriptHash()
+	transcript.Write([]byte{cnx.version})
+	transcript.Write([]byte{opcode})
+	transcript.Write(ts)
+	transcript.Write(conf.EncryptSkID)
+	transcript.Write(noncePrefix)
+	transcript.Write(cidBind)
+
+	header := make([]byte, 32)
+	copy(header[0:8], ts)
+	copy(header[8:16], conf.EncryptSkID)
+	copy(header[16:32], noncePrefix)
+	cnx.progress.begin()
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	writer.Write(header)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	var chunkIndex uint64
+	sendChunk := func(plain []byte) error {
+		nonce := protocol.DeriveChunkNonce(noncePrefix, chunkIndex)
+		sealed := aead.Seal(nil, nonce, plain, nil)
+
+		chunkLen := uint32(len(plain))
+		lenBuf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lenBuf, chunkLen)
+
+		idxBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(idxBuf, chunkIndex)
+		transcript.Write(idxBuf)
+		transcript.Write(lenBuf)
+		transcript.Write(sealed)
+
+		cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+		writer.Write(lenBuf)
+		writer.Write(sealed)
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		chunkIndex++
+		return nil
+	}
+
+	plainBuf := make([]byte, protocol.MaxChunk)
+	n, readErr := io.ReadAtLeast(input, plainBuf, 1)
+	if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+		return nil, readErr
+	}
+	metadata := newMetadata(opts.Name, opts.MIMEType, input, plainBuf[:n], -1)
+	if algo := chooseCompression(conf.Compression, metadata.MIMEType, plainBuf[:n]); algo != CompressionNone {
+		metadata.Compression = algo
+		uncompressed := io.MultiReader(bytes.NewReader(bytes.Clone(plainBuf[:n])), input)
+		if readErr != nil {
+			uncompressed = bytes.NewReader(bytes.Clone(plainBuf[:n]))
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			cw, err := newCompressWriter(algo, pw)
+			if err == nil {
+				if _, err = io.Copy(cw, uncompressed); err == nil {
+					err = cw.Close()
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		input = pr
+		n, readErr = io.ReadAtLeast(input, plainBuf, 1)
+	}
+	if err := sendChunk(metadata.encode()); err != nil {
+		return nil, err
+	}
+	if metadata.Compression == CompressionNone && metadata.Size >= 0 {
+		cnx.progress.setTotal(uint64(metadata.Size))
+	}
+
+	for {
+		if n > 0 {
+			if err := sendChunk(plainBuf[:n]); err != nil {
+				return nil, err
+			}
+			cnx.progress.add(uint64(n), 1)
+		}
+		if readErr != nil {
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, readErr
+		}
+		n, readErr = io.ReadAtLeast(input, plainBuf, 1)
+	}
+
+	transcriptDigest := transcript.Sum(nil)
+	signature := ed25519.Sign(conf.SignSk, transcriptDigest)
+
+	endMarker := make([]byte, 4)
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	writer.Write(endMarker)
+	writer.Write(signature)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	if opts.Store {
+		storeStatus, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("The server didn't confirm that the stream was stored: %w", err)
+		}
+		if storeStatus != 0x01 {
+			return nil, errors.New("The server failed to store the stream")
+		}
+	}
+	if opts.Ack {
+		return result, cnx.receiveStreamAcks(noncePrefix, transcriptDigest, result)
+	}
+	return result, nil
+}
+
+// receiveStreamAcks - Collects whether each puller verified the stream.
+// Fails unless they all did, including the ones the stream started with.
+func (cnx *connection) receiveStreamAcks(noncePrefix []byte, transcriptDigest []byte, result *PushResult) error {
+	conf, reader := cnx.conf, cnx.reader
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	var pullersCount uint32
+	if err := binary.Read(reader, binary.LittleEndian, &pullersCount); err != nil {
+		return fmt.Errorf("Stream: failed to receive acknowledgements: %w", err)
+	}
+	verified := uint32(0)
+	for i := uint32(0); i < pullersCount; i++ {
+		var ackLen uint16
+		if err := binary.Read(reader, binary.LittleEndian, &ackLen); err != nil {
+			return fmt.Errorf("Stream: failed to receive acknowledgements: %w", err)
+		}
+		if ackLen > protocol.MaxStreamAckLen {
+			return errors.New("Stream: invalid acknowledgement")
+		}
+		ack := make([]byte, ackLen)
+		if _, err := io.ReadFull(reader, ack); err != nil {
+			return fmt.Errorf("Stream: failed to receive acknowledgements: %w", err)
+		}
+		if ackLen == 0 {
+			result.Acks = append(result.Acks, Ack{Status: AckMissing})
+			continue
+		}
+		if ackLen < 2+32 || int(ack[1]) != int(ackLen)-2-32 {
+			result.Acks = append(result.Acks, Ack{Status: AckInvalid})
+			continue
+		}
+		status, hostname := ack[0], ack[2:ackLen-32]
+		if subtle.ConstantTimeCompare(ack[ackLen-32:], protocol.StreamAckMAC(conf.EncryptSk, noncePrefix, transcriptDigest, status, hostname)) != 1 {
+			result.Acks = append(result.Acks, Ack{Status: AckInvalid})
+			continue
+		}
+		if status != 0x01 {
+			result.Acks = append(result.Acks, Ack{Hostname: string(hostname), Status: AckFailed})
+			continue
+		}
+		result.Acks = append(result.Acks, Ack{Hostname: string(hostname), Status: AckVerified})
+		verified++
+	}
+	if pullersCount < result.Pullers {
+		result.Left = result.Pullers - pullersCount
+		pullersCount = result.Pullers
+	}
+	if pullersCount == 0 {
+		return errors.New("No pullers received the stream")
+	}
+	if verified < pullersCount {
+		return fmt.Errorf("Only %v of the %v pullers verified the stream", verified, pullersCount)
+	}
+	return nil
+}
+
+// checkStreamHeader - Checks the timestamp and the key ID of a stream header
+func checkStreamHeader(conf Config, header []byte) error {
+	ts := header[0:8]
+	encryptSkID := header[8:16]
+
+	tsRaw := binary.LittleEndian.Uint64(ts)
+	if tsRaw > uint64(math.MaxInt64) {
+		return errors.New("Stream rejected: invalid timestamp")
+	}
+	tsVal := int64(tsRaw)
+	now := time.Now().Unix()
+	maxFutureSeconds := int64(protocol.MaxFutureSkew / time.Second)
+	ttlSeconds := int64(conf.TTL / time.Second)
+	if tsVal > now {
+		if tsVal-now > maxFutureSeconds {
+			return errors.New("Stream rejected: timestamp too far in the future")
+		}
+	} else {
+		if now-tsVal > ttlSeconds {
+			return errorf(ErrTooOld, "Stream rejected: timestamp too old")
+		}
+	}
+
+	if !bytes.Equal(conf.EncryptSkID, encryptSkID) {
+		return keyIDMismatch(conf, "stream", encryptSkID)
+	}
+	return nil
+}
+
+// streamPull - State of a stream being pulled, kept across connections so that
+// an interrupted stream can be resumed
+type streamPull struct {
+	cid          string
+	store        bool
+	header       []byte
+	aead         cipher.AEAD
+	transcript   hash.Hash
+	chunkIndex   uint64
+	totalBytes   uint64
+	start        time.Time
+	destination  io.Writer
+	output       io.Writer
+	decompressed chan error
+	verified     func() error
+}
+
+// startStreamPull - Checks the header of a new stream, and initializes the
+// decryption and the transcript
+func (cnx *connection) startStreamPull(header []byte, pull *streamPull) error {
+	conf := cnx.conf
+	ts := header[0:8]
+	encryptSkID := header[8:16]
+	noncePrefix := header[16:32]
+
+	if err := checkStreamHeader(conf, header); err != nil {
+		return err
+	}
+
+	cidBytes := []byte(pull.cid)
+	streamKey := protocol.DeriveStreamKey(conf.EncryptSk, ts, encryptSkID, noncePrefix, cidBytes)
+	aead, err := chacha20poly1305.NewX(streamKey)
+	if err != nil {
+		return err
+	}
+
+	cidBind := protocol.ComputeCIDBind(conf.EncryptSk, cidBytes)
+	transcript := protocol.NewTranscriptHash()
+	transcript.Write([]byte{cnx.version})
+	transcript.Write([]byte{'P'})
+	transcript.Write(ts)
+	transcript.Write(encryptSkID)
+	transcript.Write(noncePrefix)
+	transcript.Write(cidBind)
+
+	pull.header, pull.aead, pull.transcript = bytes.Clone(header), aead, transcript
+	cnx.progress.begin()
+	return nil
+}
+
+// pullStream - Receives a stream, resuming it if the connection is lost
+func (cnx *connection) pullStream(ctx context.Context, h1 []byte, output io.Writer, opts *PullOptions) error {
+	pull := &streamPull{
+		cid:         opts.CID,
+		store:       opts.Store,
+		start:       time.Now(),
+		destination: output,
+		output:      output,
+		verified:    opts.Verified,
+	}
+	defer func() {
+		if pw, ok := pull.output.(*io.PipeWriter); ok && pull.output != pull.destination {
+			pw.CloseWithError(errors.New("Stream aborted"))
+			<-pull.decompressed
+		}
+	}()
+	return cnx.withRetries(ctx, h1, opts.Retries, func(cnx *connection, h1 []byte) error {
+		return cnx.pullStreamOperation(h1, pull)
+	})
+}
+
+func (cnx *connection) pullStreamOperation(h1 []byte, pull *streamPull) error {
+	conf, reader := cnx.conf, cnx.reader
+	opcode := byte('L')
+	opts := &protocol.StreamOptions{
+		Channel: protocol.DeriveChannelID(conf.EncryptSk, []byte(pull.cid)),
+		Store:   pull.store,
+	}
+	if pull.header != nil {
+		opts.Resume = &protocol.StreamResume{NoncePrefix: pull.header[16:32], ChunkIndex: pull.chunkIndex}
+	}
+	if err := cnx.sendStreamRequest(h1, opcode, opts); err != nil {
+		return err
+	}
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+	statusBuf := make([]byte, 1)
+	if _, err := io.ReadFull(reader, statusBuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrIncompatibleVersion
+		}
+		return err
+	}
+	switch statusBuf[0] {
+	case 0x01:
+	case 0x00:
+		return errors.New("A stream is already being transferred - try again later")
+	case 0x02:
+		return errors.New("Too many clients are already waiting to receive a stream")
+	case 0x03:
+		return errors.New("A stream is being transferred, but it can't be replayed any more - try again later")
+	case 0x04:
+		return errors.New("The interrupted stream can't be resumed - it was pushed without -replay or -store, or it has expired")
+	default:
+		return errors.New("Server rejected the stream pull request")
+	}
+
+	cnx.conn.SetDeadline(time.Time{})
+
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("Stream: failed to read header: %w", err)
+	}
+	if pull.header != nil {
+		if !bytes.Equal(header, pull.header) {
+			return errors.New("Stream: the server resumed a different stream")
+		}
+	} else if err := cnx.startStreamPull(header, pull); err != nil {
+		return err
+	}
+	noncePrefix := header[16:32]
+
+	maxBytes := DefaultMaxStreamBytes
+	if conf.MaxStreamBytes > 0 && conf.MaxStreamBytes < maxBytes {
+		maxBytes = conf.MaxStreamBytes
+	}
+	maxDur := DefaultMaxStreamDur
+	if conf.MaxStreamDuration > 0 && conf.MaxStreamDuration < maxDur {
+		maxDur = conf.MaxStreamDuration
+	}
+
+	for {
+		cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+		var chunkLen uint32
+		if err := binary.Read(reader, binary.LittleEndian, &chunkLen); err != nil {
+			return fmt.Errorf("Stream: failed to read chunk length: %w", err)
+		}
+
+		if chunkLen == protocol.StreamDroppedMarker {
+			return errors.New("Stream: the server dropped this client, as it was too slow to receive the stream")
+		}
+		if chunkLen == 0 {
+			sig := make([]byte, 64)
+			if _, err := io.ReadFull(reader, sig); err != nil {
+				return fmt.Errorf("Stream: failed to read signature: %w", err)
+			}
+			transcriptDigest := pull.transcript.Sum(nil)
+			var err error
+			if !ed25519.Verify(conf.SignPk, transcriptDigest, sig) {
+				err = errorf(ErrBadSignature, "Stream signature verification failed")
+			} else if pull.decompressed != nil {
+				pull.output.(*io.PipeWriter).Close()
+				pull.output = pull.destination
+				if derr := <-pull.decompressed; derr != nil {
+					err = fmt.Errorf("Stream: %v", derr)
+				}
+			}
+			if err == nil && pull.verified != nil {
+				if verr := pull.verified(); verr != nil {
+					err = fmt.Errorf("Stream: %v", verr)
+				}
+			}
+			cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+			if ackRequest, rerr := reader.ReadByte(); rerr == nil && ackRequest == 0x01 {
+				cnx.sendStreamAck(noncePrefix, transcriptDigest, err == nil)
+			}
+			return err
+		}
+
+		if chunkLen > protocol.MaxChunk {
+			return fmt.Errorf("Stream: chunk too large (%v > %v)", chunkLen, protocol.MaxChunk)
+		}
+
+		sealedLen := int(chunkLen) + 16
+		pull.totalBytes += uint64(sealedLen)
+		if pull.totalBytes > maxBytes {
+			return errors.New("Stream rejected: exceeded maximum stream size")
+		}
+		if time.Since(pull.start) > maxDur {
+			return errors.New("Stream rejected: exceeded maximum stream duration")
+		}
+		sealed := make([]byte, sealedLen)
+		cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+		if _, err := io.ReadFull(reader, sealed); err != nil {
+			pull.totalBytes -= uint64(sealedLen)
+			return fmt.Errorf("Stream: failed to read chunk data: %w", err)
+		}
+
+		chunkIndex := pull.chunkIndex
+		nonce := protocol.DeriveChunkNonce(noncePrefix, chunkIndex)
+		plain, err := pull.aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			return fmt.Errorf("Stream: AEAD authentication failed for chunk %v", chunkIndex)
+		}
+
+		lenBuf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lenBuf, chunkLen)
+		idxBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(idxBuf, chunkIndex)
+		pull.transcript.Write(idxBuf)
+		pull.transcript.Write(lenBuf)
+		pull.transcript.Write(sealed)
+		pull.chunkIndex++
+
+		if chunkIndex == 0 {
+			var metadata *Metadata
+			if metadata, plain, err = splitMetadata(plain); err != nil {
+				return fmt.Errorf("Stream: %v", err)
+			}
+			if metadata != nil && metadata.Compression == CompressionNone && metadata.Size >= 0 {
+				cnx.progress.setTotal(uint64(metadata.Size))
+			}
+			if metadata != nil && metadata.Compression != CompressionNone {
+				pr, pw := io.Pipe()
+				decompressed := make(chan error, 1)
+				go func() {
+					err := decompressTo(metadata.Compression, pull.destination, pr, conf.MaxDecompressedSize, metadata.Size)
+					pr.CloseWithError(err)
+					decompressed <- err
+				}()
+				pull.output, pull.decompressed = pw, decompressed
+			}
+		}
+		if chunkIndex > 0 || len(plain) > 0 {
+			cnx.progress.add(uint64(len(plain)), 1)
+		}
+		if _, err := pull.output.Write(plain); err != nil {
+			return fmt.Errorf("Stream: write error: %v", err)
+		}
+	}
+}
+
+// sendStreamAck - Tells the pusher whether the stream was verified, once the
+// server has asked for it
+func (cnx *connection) sendStreamAck(noncePrefix []byte, transcriptDigest []byte, verified bool) {
+	conf, writer := cnx.conf, cnx.writer
+	status := byte(0x00)
+	if verified {
+		status = 0x01
+	}
+	hostname, _ := os.Hostname()
+	if len(hostname) > 255 {
+		hostname = hostname[:255]
+	}
+	cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+	writer.Write([]byte{status, byte(len(hostname))})
+	writer.WriteString(hostname)
+	writer.Write(protocol.StreamAckMAC(conf.EncryptSk, noncePrefix, transcriptDigest, status, []byte(hostname)))
+	writer.Flush()
+}
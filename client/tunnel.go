@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TunnelRole - Which clients a tunnel can be paired with
+type TunnelRole byte
+
+const (
+	// TunnelPeer - Paired with another client using TunnelPeer
+	TunnelPeer = TunnelRole(protocol.TunnelRolePeer)
+	// TunnelConnect - Paired with a client using TunnelAccept, failing
+	// right away if there is none
+	TunnelConnect = TunnelRole(protocol.TunnelRoleConnect)
+	// TunnelAccept - Waits for a client using TunnelConnect
+	TunnelAccept = TunnelRole(protocol.TunnelRoleAccept)
+)
+
+// Tunnel - A full-duplex pipe with another client
+type Tunnel struct {
+	cnx *connection
+	cid string
+}
+
+// OpenTunnel - Waits until the server pairs the client with a peer using the
+// same content identifier. The tunnel is closed if ctx is canceled.
+func (c *Client) OpenTunnel(ctx context.Context, cid string, role TunnelRole) (*Tunnel, error) {
+	cnx, h1, err := c.connect(ctx, 8)
+	if err != nil {
+		return nil, err
+	}
+	if err := cnx.openTunnel(h1, cid, byte(role)); err != nil {
+		cnx.close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &Tunnel{cnx: cnx, cid: cid}, nil
+}
+
+// Close - Closes the tunnel
+func (tunnel *Tunnel) Close() error {
+	tunnel.cnx.close()
+	return nil
+}
+
+// openTunnel - Waits until the server pairs the client with a peer
+func (cnx *connection) openTunnel(h1 []byte, cid string, role byte) error {
+	conf, reader := cnx.conf, cnx.reader
+	if err := cnx.sendStreamRequest(h1, byte('T'), &protocol.StreamOptions{
+		Channel:    protocol.DeriveChannelID(conf.EncryptSk, []byte(cid)),
+		TunnelRole: role,
+	}); err != nil {
+		return err
+	}
+	cnx.conn.SetDeadline(time.Time{})
+	statusBuf := make([]byte, 1)
+	if _, err := io.ReadFull(reader, statusBuf); err != nil {
+		if role == protocol.TunnelRoleConnect {
+			return errors.New("No client is exposing a service on this channel")
+		}
+		return fmt.Errorf("Tunnel: no peer showed up: %w", err)
+	}
+	if statusBuf[0] != 0x01 {
+		return errors.New("Server rejected the tunnel request")
+	}
+	return nil
+}
+
+// Run - Exchanges data with the peer: what is read from input is sent to the
+// peer, and what the peer sends is written to output. Returns once both
+// directions are closed.
+func (tunnel *Tunnel) Run(input io.Reader, output io.Writer) error {
+	cnx := tunnel.cnx
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint64(header[0:8], uint64(time.Now().Unix()))
+	copy(header[8:16], conf.EncryptSkID)
+	if _, err := rand.Read(header[16:32]); err != nil {
+		return err
+	}
+	writer.Write(header)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	peerHeader := make([]byte, 32)
+	if _, err := io.ReadFull(reader, peerHeader); err != nil {
+		return fmt.Errorf("Tunnel: failed to read the peer header: %v", err)
+	}
+	if err := checkStreamHeader(conf, peerHeader); err != nil {
+		return err
+	}
+	cidBytes := []byte(tunnel.cid)
+	noncePrefix, peerNoncePrefix := header[16:32], peerHeader[16:32]
+	sendAEAD, err := chacha20poly1305.NewX(protocol.DeriveTunnelKey(conf.EncryptSk, header[0:8], conf.EncryptSkID,
+		noncePrefix, peerNoncePrefix, cidBytes))
+	if err != nil {
+		return err
+	}
+	receiveAEAD, err := chacha20poly1305.NewX(protocol.DeriveTunnelKey(conf.EncryptSk, peerHeader[0:8], conf.EncryptSkID,
+		peerNoncePrefix, noncePrefix, cidBytes))
+	if err != nil {
+		return err
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendTunnel(writer, sendAEAD, noncePrefix, input)
+	}()
+
+	var chunkIndex uint64
+	for {
+		var chunkLen uint32
+		if err := binary.Read(reader, binary.LittleEndian, &chunkLen); err != nil {
+			return fmt.Errorf("Tunnel: connection lost: %v", err)
+		}
+		if chunkLen > protocol.MaxChunk {
+			return fmt.Errorf("Tunnel: chunk too large (%v > %v)", chunkLen, protocol.MaxChunk)
+		}
+		sealed := make([]byte, int(chunkLen)+16)
+		if _, err := io.ReadFull(reader, sealed); err != nil {
+			return fmt.Errorf("Tunnel: connection lost: %v", err)
+		}
+		plain, err := receiveAEAD.Open(nil, protocol.DeriveChunkNonce(peerNoncePrefix, chunkIndex), sealed, nil)
+		if err != nil {
+			return fmt.Errorf("Tunnel: AEAD authentication failed for chunk %v", chunkIndex)
+		}
+		chunkIndex++
+		if chunkLen == 0 {
+			break
+		}
+		if _, err := output.Write(plain); err != nil {
+			return fmt.Errorf("Tunnel: write error: %v", err)
+		}
+	}
+	if closer, ok := output.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+	return <-sent
+}
+
+// sendTunnel - Sends what is read from input to the peer, followed by an
+// empty frame once input is exhausted
+func sendTunnel(writer *bufio.Writer, aead cipher.AEAD, noncePrefix []byte, input io.Reader) error {
+	buf := make([]byte, protocol.MaxChunk)
+	var chunkIndex uint64
+	for {
+		n, err := input.Read(buf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 && err == nil {
+			continue
+		}
+		binary.Write(writer, binary.LittleEndian, uint32(n))
+		writer.Write(aead.Seal(nil, protocol.DeriveChunkNonce(noncePrefix, chunkIndex), buf[:n], nil))
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		chunkIndex++
+	}
+}
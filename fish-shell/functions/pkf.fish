@@ -1,3 +1,3 @@
 function pkf --description 'copy the content of a file to the piknik clipboard'
-	piknik -copy < $argv[1];
+	piknik -copy -name $argv[1] < $argv[1];
 end
@@ -1,3 +1,7 @@
-function pkfr --description 'send a whole directory to the piknik clipboard, as a tar archive'
-	tar czpvf - $argv | piknik -copy
+function pkfr --description 'send whole directories to the piknik clipboard'
+	if test (count $argv) -eq 0
+		piknik -copy-file .
+	else
+		piknik -copy-file $argv
+	end
 end
@@ -1,3 +1,3 @@
 function pkpr --description 'extract piknik clipboard content sent using the pkfr command'
-	piknik -paste | tar xzpvf -
+	piknik -paste-to .
 end
@@ -1,3 +1,3 @@
 function pkz --description 'delete the piknik clipboard content'
-	piknik -copy < /dev/null;
+	piknik -clear;
 end
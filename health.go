@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jedisct1/piknik/server"
+)
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func readyzHandler(conf Conf, srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.Listening() {
+			http.Error(w, "not listening", http.StatusServiceUnavailable)
+			return
+		}
+		clients := uint64(0)
+		for _, client := range srv.Clients() {
+			if client.Opcode != 'W' {
+				clients++
+			}
+		}
+		// Slots reserved for trusted IPs can't be used by new clients
+		if clients >= conf.MaxClients-conf.TrustedIPCount {
+			http.Error(w, "too many clients", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+func runHealthServer(conf Conf, srv *server.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler(conf, srv))
+	healthServer := &http.Server{
+		Addr:              conf.HealthListen,
+		Handler:           mux,
+		ReadHeaderTimeout: conf.Timeout,
+		WriteTimeout:      conf.Timeout,
+		IdleTimeout:       time.Minute,
+	}
+	log.Fatal(healthServer.ListenAndServe())
+}
@@ -0,0 +1,281 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"hash"
+
+	blake2b "github.com/minio/blake2b-simd"
+)
+
+func Auth0(psk []byte, clientVersion byte, r []byte) []byte {
+	hf0, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{0},
+	})
+	hf0.Write([]byte{clientVersion})
+	hf0.Write(r)
+	h0 := hf0.Sum(nil)
+
+	return h0
+}
+
+func Auth1(psk []byte, clientVersion byte, h0 []byte, r2 []byte) []byte {
+	hf1, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{1},
+	})
+	hf1.Write([]byte{clientVersion})
+	hf1.Write(r2)
+	hf1.Write(h0)
+	h1 := hf1.Sum(nil)
+
+	return h1
+}
+
+func Auth2Get(psk []byte, clientVersion byte, h1 []byte, opcode byte) []byte {
+	hf2, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{2},
+	})
+	hf2.Write(h1)
+	hf2.Write([]byte{opcode})
+	h2 := hf2.Sum(nil)
+
+	return h2
+}
+
+func Auth2Store(psk []byte, clientVersion byte, h1 []byte, opcode byte,
+	ts []byte, signature []byte,
+) []byte {
+	hf2, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{2},
+	})
+	hf2.Write(h1)
+	hf2.Write([]byte{opcode})
+	hf2.Write(ts)
+	hf2.Write(signature)
+	h2 := hf2.Sum(nil)
+
+	return h2
+}
+
+func Auth2Wait(psk []byte, clientVersion byte, h1 []byte, opcode byte,
+	flags byte, timeout []byte,
+) []byte {
+	hf2, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{2},
+	})
+	hf2.Write(h1)
+	hf2.Write([]byte{opcode})
+	hf2.Write([]byte{flags})
+	hf2.Write(timeout)
+	h2 := hf2.Sum(nil)
+
+	return h2
+}
+
+func Auth2Upload(psk []byte, clientVersion byte, h1 []byte, opcode byte,
+	uploadID []byte, contentLen []byte, ts []byte, signature []byte,
+) []byte {
+	hf2, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{2},
+	})
+	hf2.Write(h1)
+	hf2.Write([]byte{opcode})
+	hf2.Write(uploadID)
+	hf2.Write(contentLen)
+	hf2.Write(ts)
+	hf2.Write(signature)
+	h2 := hf2.Sum(nil)
+
+	return h2
+}
+
+func Auth2Stream(psk []byte, clientVersion byte, h1 []byte, opcode byte, opts []byte) []byte {
+	hf2, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{2},
+	})
+	hf2.Write(h1)
+	hf2.Write([]byte{opcode})
+	hf2.Write(opts)
+	h2 := hf2.Sum(nil)
+
+	return h2
+}
+
+func Auth3Get(psk []byte, clientVersion byte, h2 []byte,
+	ts []byte, signature []byte,
+) []byte {
+	hf3, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{3},
+	})
+	hf3.Write(h2)
+	hf3.Write(ts)
+	hf3.Write(signature)
+	h3 := hf3.Sum(nil)
+
+	return h3
+}
+
+func Auth3Info(psk []byte, h2 []byte, ts []byte, contentLen []byte,
+	encryptSkID []byte, signature []byte,
+) []byte {
+	hf3, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{3},
+	})
+	hf3.Write(h2)
+	hf3.Write(ts)
+	hf3.Write(contentLen)
+	hf3.Write(encryptSkID)
+	hf3.Write(signature)
+	h3 := hf3.Sum(nil)
+
+	return h3
+}
+
+func Auth3Store(psk []byte, h2 []byte) []byte {
+	hf3, _ := blake2b.New(&blake2b.Config{
+		Key:    psk,
+		Person: []byte(DomainStr),
+		Size:   32,
+		Salt:   []byte{3},
+	})
+	hf3.Write(h2)
+	h3 := hf3.Sum(nil)
+
+	return h3
+}
+
+func DeriveStreamKey(encryptSk []byte, ts []byte, encryptSkID []byte, noncePrefix []byte, cidBytes []byte) []byte {
+	hf, _ := blake2b.New(&blake2b.Config{
+		Key:    encryptSk,
+		Person: []byte("pkv7-stream-key"),
+		Size:   32,
+	})
+	hf.Write(ts)
+	hf.Write(encryptSkID)
+	hf.Write(noncePrefix)
+	cidLen := make([]byte, 2)
+	binary.LittleEndian.PutUint16(cidLen, uint16(len(cidBytes)))
+	hf.Write(cidLen)
+	hf.Write(cidBytes)
+	return hf.Sum(nil)
+}
+
+// DeriveTunnelKey - Key for one direction of a tunnel. Both peers choose a
+// random nonce prefix, so that the key of each direction is fresh even if the
+// other peer isn't.
+func DeriveTunnelKey(encryptSk []byte, ts []byte, encryptSkID []byte, senderNoncePrefix []byte,
+	receiverNoncePrefix []byte, cidBytes []byte,
+) []byte {
+	hf, _ := blake2b.New(&blake2b.Config{
+		Key:    encryptSk,
+		Person: []byte("pk-v8-tunnel-key"),
+		Size:   32,
+	})
+	hf.Write(ts)
+	hf.Write(encryptSkID)
+	hf.Write(senderNoncePrefix)
+	hf.Write(receiverNoncePrefix)
+	cidLen := make([]byte, 2)
+	binary.LittleEndian.PutUint16(cidLen, uint16(len(cidBytes)))
+	hf.Write(cidLen)
+	hf.Write(cidBytes)
+	return hf.Sum(nil)
+}
+
+func ComputeCIDBind(encryptSk []byte, cidBytes []byte) []byte {
+	if len(cidBytes) == 0 {
+		return make([]byte, 32)
+	}
+	hf, _ := blake2b.New(&blake2b.Config{
+		Key:    encryptSk,
+		Person: []byte("pk-v7-cid-bind"),
+		Size:   32,
+	})
+	cidLen := make([]byte, 2)
+	binary.LittleEndian.PutUint16(cidLen, uint16(len(cidBytes)))
+	hf.Write(cidLen)
+	hf.Write(cidBytes)
+	return hf.Sum(nil)
+}
+
+// DeriveChannelID - Stream channel identifier, that pushers and pullers using
+// the same key and content identifier share, without revealing the latter
+func DeriveChannelID(encryptSk []byte, cidBytes []byte) []byte {
+	hf, _ := blake2b.New(&blake2b.Config{
+		Key:    encryptSk,
+		Person: []byte("pk-v8-channel"),
+		Size:   ChannelIDLen,
+	})
+	cidLen := make([]byte, 2)
+	binary.LittleEndian.PutUint16(cidLen, uint16(len(cidBytes)))
+	hf.Write(cidLen)
+	hf.Write(cidBytes)
+	return hf.Sum(nil)
+}
+
+// LiveStreamEndDigest - Digest signed at the end of a live stream, that
+// pullers can verify without having received the whole stream
+func LiveStreamEndDigest(header []byte, chunkCount uint64) []byte {
+	hf, _ := blake2b.New(&blake2b.Config{
+		Person: []byte("pk-v8-live-end"),
+		Size:   32,
+	})
+	hf.Write(header)
+	hf.Write(binary.LittleEndian.AppendUint64(nil, chunkCount))
+	return hf.Sum(nil)
+}
+
+// StreamAckMAC - Authenticates the acknowledgement of a stream by a puller
+func StreamAckMAC(encryptSk []byte, noncePrefix []byte, transcriptDigest []byte, status byte, hostname []byte) []byte {
+	hf, _ := blake2b.New(&blake2b.Config{
+		Key:    encryptSk,
+		Person: []byte("pk-v8-stream-ack"),
+		Size:   32,
+	})
+	hf.Write(noncePrefix)
+	hf.Write(transcriptDigest)
+	hf.Write([]byte{status, byte(len(hostname))})
+	hf.Write(hostname)
+	return hf.Sum(nil)
+}
+
+func NewTranscriptHash() hash.Hash {
+	hf, _ := blake2b.New(&blake2b.Config{
+		Person: []byte("pk-v7-transcript"),
+		Size:   32,
+	})
+	return hf
+}
+
+func DeriveChunkNonce(noncePrefix []byte, chunkIndex uint64) []byte {
+	nonce := make([]byte, 24)
+	copy(nonce, noncePrefix)
+	binary.LittleEndian.PutUint64(nonce[16:], chunkIndex)
+	return nonce
+}
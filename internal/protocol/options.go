@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Since protocol version 8, stream push and pull requests carry a set of
+// options, authenticated along with the opcode.
+//
+// options := uint16_le(len(body)) || body
+// body    := (tag(1) || uint16_le(len(value)) || value)*
+
+const (
+	ChannelIDLen = 16
+
+	streamOptChannel     = byte(0x01)
+	streamOptWaitPullers = byte(0x02)
+	streamOptWaitTimeout = byte(0x03)
+	streamOptReplay      = byte(0x04)
+	streamOptStore       = byte(0x05)
+	streamOptResume      = byte(0x06)
+	streamOptTunnelRole  = byte(0x07)
+	streamOptLive        = byte(0x08)
+	streamOptAck         = byte(0x09)
+
+	maxStreamOptionsLen = 4096
+	MaxLiveInputLen     = 16 + 8 + MaxChunk + 16
+	MaxStreamAckLen     = 1 + 1 + 255 + 32
+)
+
+// StreamOptions - Options of a stream push, pull or tunnel request
+type StreamOptions struct {
+	Channel     []byte
+	WaitPullers uint32
+	WaitTimeout time.Duration
+	Replay      time.Duration
+	// Store - Store a pushed stream, or receive the stored stream when
+	// pulling
+	Store      bool
+	Resume     *StreamResume
+	TunnelRole byte
+	// Live - Push or join a live stream, that can't be stored or
+	// acknowledged
+	Live bool
+	Ack  bool
+}
+
+// StreamResume - Position from which a puller resumes an interrupted stream:
+// the nonce prefix of the stream, and the index of the first chunk to send
+type StreamResume struct {
+	NoncePrefix []byte
+	ChunkIndex  uint64
+}
+
+func (opts *StreamOptions) Encode() []byte {
+	var body bytes.Buffer
+	writeTag := func(tag byte, value []byte) {
+		body.WriteByte(tag)
+		binary.Write(&body, binary.LittleEndian, uint16(len(value)))
+		body.Write(value)
+	}
+	writeTag(streamOptChannel, opts.Channel)
+	if opts.WaitPullers > 0 {
+		writeTag(streamOptWaitPullers, binary.LittleEndian.AppendUint32(nil, opts.WaitPullers))
+		writeTag(streamOptWaitTimeout, binary.LittleEndian.AppendUint64(nil, uint64(opts.WaitTimeout/time.Second)))
+	}
+	if opts.Store {
+		writeTag(streamOptStore, []byte{1})
+	}
+	if opts.Replay > 0 {
+		writeTag(streamOptReplay, binary.LittleEndian.AppendUint64(nil, uint64(opts.Replay.Round(time.Second)/time.Second)))
+	}
+	if opts.Resume != nil {
+		writeTag(streamOptResume, binary.LittleEndian.AppendUint64(bytes.Clone(opts.Resume.NoncePrefix), opts.Resume.ChunkIndex))
+	}
+	if opts.Live {
+		writeTag(streamOptLive, []byte{1})
+	}
+	if opts.Ack {
+		writeTag(streamOptAck, []byte{1})
+	}
+	if opts.TunnelRole != TunnelRolePeer {
+		writeTag(streamOptTunnelRole, []byte{opts.TunnelRole})
+	}
+	encoded := make([]byte, 0, 2+body.Len())
+	encoded = binary.LittleEndian.AppendUint16(encoded, uint16(body.Len()))
+	return append(encoded, body.Bytes()...)
+}
+
+// ReadStreamOptions - Reads encoded options, returned as-is so that they can
+// be authenticated before being decoded
+func ReadStreamOptions(reader io.Reader) ([]byte, error) {
+	encoded := make([]byte, 2)
+	if _, err := io.ReadFull(reader, encoded); err != nil {
+		return nil, err
+	}
+	bodyLen := binary.LittleEndian.Uint16(encoded)
+	if bodyLen > maxStreamOptionsLen {
+		return nil, fmt.Errorf("Stream options too long (%v bytes)", bodyLen)
+	}
+	encoded = append(encoded, make([]byte, bodyLen)...)
+	if _, err := io.ReadFull(reader, encoded[2:]); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// DecodeStreamOptions - Decodes options, ignoring unknown tags
+func DecodeStreamOptions(encoded []byte) (*StreamOptions, error) {
+	body := encoded[2:]
+	opts := &StreamOptions{}
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, errors.New("Truncated stream options")
+		}
+		tag, valueLen := body[0], int(binary.LittleEndian.Uint16(body[1:3]))
+		body = body[3:]
+		if valueLen > len(body) {
+			return nil, errors.New("Truncated stream options")
+		}
+		value := body[:valueLen]
+		body = body[valueLen:]
+		switch tag {
+		case streamOptChannel:
+			if len(value) != ChannelIDLen {
+				return nil, errors.New("Invalid stream channel")
+			}
+			opts.Channel = value
+		case streamOptWaitPullers:
+			if len(value) != 4 {
+				return nil, errors.New("Invalid number of pullers to wait for")
+			}
+			opts.WaitPullers = binary.LittleEndian.Uint32(value)
+		case streamOptWaitTimeout:
+			if len(value) != 8 {
+				return nil, errors.New("Invalid wait timeout")
+			}
+			opts.WaitTimeout = decodeDuration(value)
+		case streamOptReplay:
+			if len(value) != 8 {
+				return nil, errors.New("Invalid replay duration")
+			}
+			opts.Replay = decodeDuration(value)
+		case streamOptStore:
+			if len(value) != 1 {
+				return nil, errors.New("Invalid store option")
+			}
+			opts.Store = value[0] != 0
+		case streamOptLive:
+			if len(value) != 1 {
+				return nil, errors.New("Invalid live option")
+			}
+			opts.Live = value[0] != 0
+		case streamOptAck:
+			if len(value) != 1 {
+				return nil, errors.New("Invalid ack option")
+			}
+			opts.Ack = value[0] != 0
+		case streamOptTunnelRole:
+			if len(value) != 1 {
+				return nil, errors.New("Invalid tunnel role")
+			}
+			opts.TunnelRole = value[0]
+		case streamOptResume:
+			if len(value) != 16+8 {
+				return nil, errors.New("Invalid stream resumption position")
+			}
+			opts.Resume = &StreamResume{
+				NoncePrefix: value[:16],
+				ChunkIndex:  binary.LittleEndian.Uint64(value[16:]),
+			}
+		}
+	}
+	if opts.Channel == nil {
+		return nil, errors.New("Missing stream channel")
+	}
+	if opts.Live && (opts.Store || opts.Ack) {
+		return nil, errors.New("Live streams can't be stored or acknowledged")
+	}
+	return opts, nil
+}
+
+// decodeDuration - Decodes a number of seconds, capped to MaxWaitDuration
+func decodeDuration(value []byte) time.Duration {
+	return time.Duration(min(binary.LittleEndian.Uint64(value), uint64(MaxWaitDuration/time.Second))) * time.Second
+}
+
+// ChannelLabel - Short representation of a channel identifier for logs
+func ChannelLabel(channelID []byte) string {
+	return hex.EncodeToString(channelID[:4])
+}
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testChannel() []byte {
+	return bytes.Repeat([]byte{0x42}, ChannelIDLen)
+}
+
+// encodeTags - Encodes raw options, to build requests that Encode wouldn't
+func encodeTags(tags ...[]byte) []byte {
+	body := bytes.Join(tags, nil)
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(body))), body...)
+}
+
+func tag(t byte, value []byte) []byte {
+	return append(binary.LittleEndian.AppendUint16([]byte{t}, uint16(len(value))), value...)
+}
+
+func TestStreamOptionsRoundTrip(t *testing.T) {
+	tests := []StreamOptions{
+		{Channel: testChannel()},
+		{Channel: testChannel(), WaitPullers: 3, WaitTimeout: 90 * time.Second},
+		{Channel: testChannel(), Replay: 5 * time.Minute, Store: true, Ack: true},
+		{Channel: testChannel(), Resume: &StreamResume{NoncePrefix: bytes.Repeat([]byte{7}, 16), ChunkIndex: 1234}},
+		{Channel: testChannel(), Live: true},
+		{Channel: testChannel(), TunnelRole: TunnelRoleAccept},
+	}
+	for _, opts := range tests {
+		encoded := opts.Encode()
+		read, err := ReadStreamOptions(bytes.NewReader(append(bytes.Clone(encoded), "trailing data"...)))
+		if err != nil {
+			t.Fatalf("ReadStreamOptions(%+v): %v", opts, err)
+		}
+		if !bytes.Equal(read, encoded) {
+			t.Fatalf("ReadStreamOptions(%+v) = %x, want %x", opts, read, encoded)
+		}
+		decoded, err := DecodeStreamOptions(read)
+		if err != nil {
+			t.Fatalf("DecodeStreamOptions(%+v): %v", opts, err)
+		}
+		if !reflect.DeepEqual(*decoded, opts) {
+			t.Fatalf("DecodeStreamOptions() = %+v, want %+v", *decoded, opts)
+		}
+	}
+}
+
+func TestStreamOptionsReplayRounding(t *testing.T) {
+	opts := StreamOptions{Channel: testChannel(), Replay: 1500 * time.Millisecond}
+	decoded, err := DecodeStreamOptions(opts.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Replay != 2*time.Second {
+		t.Fatalf("Replay = %v, want 2s", decoded.Replay)
+	}
+}
+
+func TestDecodeStreamOptionsCapsDurations(t *testing.T) {
+	huge := binary.LittleEndian.AppendUint64(nil, 1<<62)
+	decoded, err := DecodeStreamOptions(encodeTags(
+		tag(streamOptChannel, testChannel()),
+		tag(streamOptWaitTimeout, huge),
+		tag(streamOptReplay, huge),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.WaitTimeout != MaxWaitDuration || decoded.Replay != MaxWaitDuration {
+		t.Fatalf("durations = %v, %v, want %v", decoded.WaitTimeout, decoded.Replay, MaxWaitDuration)
+	}
+}
+
+func TestDecodeStreamOptionsIgnoresUnknownTags(t *testing.T) {
+	decoded, err := DecodeStreamOptions(encodeTags(
+		tag(0xee, []byte("from a future version")),
+		tag(streamOptChannel, testChannel()),
+		tag(streamOptLive, []byte{1}),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Channel, testChannel()) || !decoded.Live {
+		t.Fatalf("DecodeStreamOptions() = %+v", *decoded)
+	}
+}
+
+func TestDecodeStreamOptionsInvalid(t *testing.T) {
+	channel := tag(streamOptChannel, testChannel())
+	tests := []struct {
+		name    string
+		encoded []byte
+	}{
+		{"no channel", encodeTags(tag(streamOptStore, []byte{1}))},
+		{"short channel", encodeTags(tag(streamOptChannel, []byte{1, 2, 3}))},
+		{"truncated tag", encodeTags(channel, []byte{streamOptStore, 1})},
+		{"truncated value", encodeTags(channel, []byte{streamOptStore, 2, 0, 1})},
+		{"wait pullers", encodeTags(channel, tag(streamOptWaitPullers, []byte{1}))},
+		{"wait timeout", encodeTags(channel, tag(streamOptWaitTimeout, []byte{1, 2, 3, 4}))},
+		{"replay", encodeTags(channel, tag(streamOptReplay, nil))},
+		{"store", encodeTags(channel, tag(streamOptStore, []byte{1, 1}))},
+		{"live", encodeTags(channel, tag(streamOptLive, nil))},
+		{"ack", encodeTags(channel, tag(streamOptAck, []byte{1, 0}))},
+		{"tunnel role", encodeTags(channel, tag(streamOptTunnelRole, nil))},
+		{"resume", encodeTags(channel, tag(streamOptResume, make([]byte, 16)))},
+		{"live and store", encodeTags(channel, tag(streamOptLive, []byte{1}), tag(streamOptStore, []byte{1}))},
+		{"live and ack", encodeTags(channel, tag(streamOptLive, []byte{1}), tag(streamOptAck, []byte{1}))},
+	}
+	for _, test := range tests {
+		if opts, err := DecodeStreamOptions(test.encoded); err == nil {
+			t.Errorf("%v: DecodeStreamOptions() = %+v, want an error", test.name, *opts)
+		}
+	}
+}
+
+func TestReadStreamOptionsLimits(t *testing.T) {
+	tooLong := binary.LittleEndian.AppendUint16(nil, maxStreamOptionsLen+1)
+	if _, err := ReadStreamOptions(bytes.NewReader(append(tooLong, make([]byte, maxStreamOptionsLen+1)...))); err == nil {
+		t.Fatal("ReadStreamOptions() accepted options longer than the limit")
+	}
+	truncated := append(binary.LittleEndian.AppendUint16(nil, 10), 1, 2, 3)
+	if _, err := ReadStreamOptions(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("ReadStreamOptions() accepted truncated options")
+	}
+}
@@ -0,0 +1,34 @@
+// Package protocol - Authentication codes, key derivations and encodings
+// shared by the Piknik client and server.
+//
+// Every connection starts with a handshake authenticated using the
+// pre-shared key, after which the client sends a one-byte opcode followed by
+// the parameters of the operation. Content is encrypted and signed by
+// clients, so that the server never has access to it.
+package protocol
+
+import "time"
+
+const (
+	// Version - Latest version of the protocol
+	Version   = byte(8)
+	DomainStr = "PK"
+
+	MaxChunk        = 65536
+	MaxFutureSkew   = time.Hour
+	MaxWaitDuration = 24 * time.Hour
+
+	// WaitFlagMove - Flag of a wait request, to delete the content once
+	// received
+	WaitFlagMove = byte(0x01)
+
+	UploadIDLen = 16
+
+	// StreamDroppedMarker - Sent instead of a frame length to a puller that
+	// has been dropped
+	StreamDroppedMarker = uint32(0xffffffff)
+
+	TunnelRolePeer    = byte(0x00)
+	TunnelRoleConnect = byte(0x01)
+	TunnelRoleAccept  = byte(0x02)
+)
@@ -0,0 +1,138 @@
+// Package ratelimit - Bandwidth limits shared by connections
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth is limited using token buckets: transferring a byte requires a
+// token, and tokens are added to the bucket at the configured rate. Several
+// connections can share a bucket, and then share the bandwidth. A nil bucket
+// doesn't limit anything.
+
+const rateLimitPiece = 16 * 1024
+
+// Bucket - Bandwidth available to the connections sharing the bucket
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket - Creates a bucket for a rate in bytes per second, or returns
+// nil if the rate is 0
+func NewBucket(rate uint64) *Bucket {
+	if rate == 0 {
+		return nil
+	}
+	burst := max(float64(rate)/10, rateLimitPiece)
+	return &Bucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait - Takes n tokens, waiting until the bucket has enough of them
+func (bucket *Bucket) Wait(n int) {
+	if bucket == nil || n <= 0 {
+		return
+	}
+	bucket.mu.Lock()
+	now := time.Now()
+	bucket.tokens = min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+	bucket.tokens -= float64(n)
+	delay := time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	bucket.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type rateLimitedReader struct {
+	r       io.Reader
+	buckets []*Bucket
+}
+
+func (lr *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p[:min(len(p), rateLimitPiece)])
+	for _, bucket := range lr.buckets {
+		bucket.Wait(n)
+	}
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	w       io.Writer
+	buckets []*Bucket
+}
+
+func (lw *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p[:min(len(p), rateLimitPiece)]
+		for _, bucket := range lw.buckets {
+			bucket.Wait(len(piece))
+		}
+		n, err := lw.w.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Limit - Returns a reader and a writer for rw, limited by all the
+// given buckets
+func Limit(rw io.ReadWriter, buckets ...*Bucket) (io.Reader, io.Writer) {
+	var limiting []*Bucket
+	for _, bucket := range buckets {
+		if bucket != nil {
+			limiting = append(limiting, bucket)
+		}
+	}
+	if len(limiting) == 0 {
+		return rw, rw
+	}
+	return &rateLimitedReader{r: rw, buckets: limiting}, &rateLimitedWriter{w: rw, buckets: limiting}
+}
+
+// ParseRate - Parses a rate in bytes per second, with an optional K, M or G
+// suffix (e.g. 5M)
+func ParseRate(rate string) (uint64, error) {
+	rate = strings.ToUpper(strings.TrimSpace(rate))
+	multiplier := uint64(1)
+	if n := len(rate); n > 0 {
+		switch rate[n-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			rate = rate[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(rate, 64)
+	if err != nil || math.IsNaN(value) || value < 0 {
+		return 0, errors.New("Invalid rate")
+	}
+	bytes := value * float64(multiplier)
+	if bytes >= math.MaxUint64 {
+		return 0, errors.New("Rate too large")
+	}
+	// 0 means unlimited, so smaller rates can't be rounded down to it
+	if bytes > 0 && bytes < 1 {
+		return 0, errors.New("Rate too small")
+	}
+	return uint64(bytes), nil
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want uint64
+	}{
+		{"0", 0},
+		{"1000", 1000},
+		{" 5k ", 5 * 1024},
+		{"1.5M", 1536 * 1024},
+		{"2G", 2 * 1024 * 1024 * 1024},
+		{"1e3", 1000},
+		{"0.5K", 512},
+		{"1.9", 1},
+	}
+	for _, test := range tests {
+		got, err := ParseRate(test.rate)
+		if err != nil || got != test.want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v", test.rate, got, err, test.want)
+		}
+	}
+	for _, rate := range []string{"", "K", "-1", "5X", "NaN", "inf", "-Inf", "1e30", "18446744073709551616", "17179869184G", "0.5", "1e-9"} {
+		if got, err := ParseRate(rate); err == nil {
+			t.Errorf("ParseRate(%q) = %v, want an error", rate, got)
+		}
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	bucket := NewBucket(0)
+	if bucket != nil {
+		t.Fatal("NewBucket(0) should return nil")
+	}
+	start := time.Now()
+	bucket.Wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("a nil bucket waited for %v", elapsed)
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	const rate = 1024 * 1024
+	bucket := NewBucket(rate)
+
+	// The bucket starts full, so the burst doesn't wait
+	start := time.Now()
+	bucket.Wait(rate / 10)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("the initial burst waited for %v", elapsed)
+	}
+
+	// The bucket is now empty, and tokens come back at the configured rate
+	start = time.Now()
+	bucket.Wait(rate / 5)
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("waited %v for 200ms worth of tokens", elapsed)
+	}
+}
+
+func TestBucketBurstIsCapped(t *testing.T) {
+	const rate = 1024 * 1024
+	bucket := NewBucket(rate)
+	time.Sleep(200 * time.Millisecond)
+
+	// Idle time doesn't accumulate more than the burst
+	bucket.Wait(rate / 10)
+	start := time.Now()
+	bucket.Wait(rate / 10)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("waited %v after the burst was used", elapsed)
+	}
+}
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func TestLimit(t *testing.T) {
+	var rw readWriter
+	if r, w := Limit(&rw, nil, nil); r != io.Reader(&rw) || w != io.Writer(&rw) {
+		t.Fatal("Limit() without buckets should return rw itself")
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	var out bytes.Buffer
+	rw = readWriter{Reader: bytes.NewReader(content), Writer: &out}
+	r, w := Limit(&rw, NewBucket(1<<30), nil)
+	read, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("read %v bytes (%v), want %v", len(read), err, len(content))
+	}
+	if n, err := w.Write(content); err != nil || n != len(content) || !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("wrote %v bytes (%v), want %v", n, err, len(content))
+	}
+}
@@ -0,0 +1,80 @@
+// Package testutil - Helpers shared by the tests of the client and the server
+package testutil
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ClientConfig - A client configuration with random keys, that servers using
+// the same Psk and SignPk accept
+func ClientConfig(t testing.TB) client.Config {
+	t.Helper()
+	psk, encryptSk, encryptSkID := make([]byte, 32), make([]byte, 32), make([]byte, 8)
+	for _, key := range [][]byte{psk, encryptSk, encryptSkID} {
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signPk, signSk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.Config{
+		Psk:         psk,
+		SignPk:      signPk,
+		SignSk:      signSk,
+		EncryptSk:   encryptSk,
+		EncryptSkID: encryptSkID,
+	}
+}
+
+// NewClient - A client using conf
+func NewClient(t testing.TB, conf client.Config) *client.Client {
+	t.Helper()
+	c, err := client.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Server - A server that can be started and stopped by tests
+type Server interface {
+	Serve(listener net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+// Serve - Starts serving on a local port, and returns the address and the
+// channel receiving what Serve returns
+func Serve(t testing.TB, srv Server) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+	return listener.Addr().String(), served
+}
+
+// Start - Serves on a local port until the test ends, and returns the address
+func Start(t testing.TB, srv Server) string {
+	t.Helper()
+	addr, served := Serve(t, srv)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		<-served
+	})
+	return addr
+}
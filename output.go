@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// With -o, received content is written to a temporary file next to the
+// destination. The file is only moved to its destination once the content has
+// been entirely received and verified, so that the destination never holds
+// partial or forged content. The temporary file is deleted if anything fails.
+
+// atomicFile - Output file that only replaces its destination once committed
+type atomicFile struct {
+	*os.File
+
+	path        string
+	finished    bool
+	interrupted chan os.Signal
+}
+
+func createAtomicFile(path string) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".piknik-*")
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		mode = info.Mode().Perm()
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	output := &atomicFile{File: file, path: path, interrupted: make(chan os.Signal, 1)}
+	signal.Notify(output.interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-output.interrupted; ok {
+			os.Remove(file.Name())
+			os.Exit(1)
+		}
+	}()
+	return output, nil
+}
+
+// finish - Stops handling signals, which ends the goroutine waiting for them.
+// Returns false if the file was already committed or aborted.
+func (output *atomicFile) finish() bool {
+	if output.finished {
+		return false
+	}
+	output.finished = true
+	signal.Stop(output.interrupted)
+	close(output.interrupted)
+	return true
+}
+
+// commit - Flushes the content to disk, and moves the file to its destination
+func (output *atomicFile) commit() error {
+	if !output.finish() {
+		return nil
+	}
+	if err := output.Sync(); err != nil {
+		output.Close()
+		os.Remove(output.Name())
+		return err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(output.Name())
+		return err
+	}
+	if err := os.Rename(output.Name(), output.path); err != nil {
+		os.Remove(output.Name())
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(output.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// abort - Deletes the temporary file, unless it has already been committed
+func (output *atomicFile) abort() {
+	if !output.finish() {
+		return
+	}
+	output.Close()
+	os.Remove(output.Name())
+}
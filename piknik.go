@@ -6,62 +6,93 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"runtime"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/jedisct1/piknik/client"
+	"github.com/jedisct1/piknik/internal/protocol"
+	"github.com/jedisct1/piknik/internal/ratelimit"
+	"github.com/jedisct1/piknik/server"
 	"github.com/minio/blake2b-simd"
 	"github.com/mitchellh/go-homedir"
 )
 
 const (
 	Version        = "0.11.0"
-	DomainStr      = "PK"
 	DefaultListen  = "0.0.0.0:8075"
 	DefaultConnect = "127.0.0.1:8075"
 	DefaultTTL     = 7 * 24 * time.Hour
-
-	MaxChunk              = 65536
-	MaxFutureSkew         = time.Hour
-	DefaultMaxWaitPullers = 100
-	DefaultMaxStreamBytes = uint64(10 * 1024 * 1024 * 1024)
-	DefaultMaxStreamDur   = 24 * time.Hour
 )
 
 type tomlConfig struct {
-	Connect           string
-	Listen            string
-	EncryptSk         string
-	EncryptSkID       uint64
-	Psk               string
-	SignPk            string
-	SignSk            string
-	Timeout           uint
-	DataTimeout       uint
-	TTL               uint
-	MaxStreamBytes    uint64
-	MaxStreamDuration uint
-	MaxWaitingPullers uint
+	Connect             string
+	Listen              string
+	EncryptSk           string
+	EncryptSkID         uint64
+	Psk                 string
+	SignPk              string
+	SignSk              string
+	Timeout             uint
+	DataTimeout         uint
+	TTL                 uint
+	MaxWatchers         uint64
+	MaxStreamBytes      uint64
+	MaxStreamDuration   uint
+	MaxWaitingPullers   uint
+	MaxReplayBytes      uint64
+	MaxReplayMemory     uint64
+	SpoolDir            string
+	SpoolRetention      uint
+	MaxSpoolBytes       uint64
+	SlowPullerPolicy    string
+	MaxSpillBytes       uint64
+	MaxSpillTotal       uint64
+	MaxRate             uint64
+	MaxConnectionRate   uint64
+	ClipboardFile       string
+	AdminSocket         string
+	HealthListen        string
+	Compression         string
+	MaxDecompressedSize int64
 }
 
 type Conf struct {
-	Connect           string
-	Listen            string
-	MaxClients        uint64
-	MaxLen            uint64
-	EncryptSk         []byte
-	EncryptSkID       []byte
-	Psk               []byte
-	SignPk            []byte
-	SignSk            []byte
-	Timeout           time.Duration
-	DataTimeout       time.Duration
-	TTL               time.Duration
-	TrustedIPCount    uint64
-	MaxStreamBytes    uint64
-	MaxStreamDuration time.Duration
-	MaxWaitingPullers uint
+	Connect             string
+	Listen              string
+	MaxClients          uint64
+	MaxLen              uint64
+	EncryptSk           []byte
+	EncryptSkID         []byte
+	Psk                 []byte
+	SignPk              []byte
+	SignSk              []byte
+	Timeout             time.Duration
+	DataTimeout         time.Duration
+	TTL                 time.Duration
+	TrustedIPCount      uint64
+	MaxWatchers         uint64
+	MaxStreamBytes      uint64
+	MaxStreamDuration   time.Duration
+	MaxWaitingPullers   uint
+	MaxReplayBytes      uint64
+	MaxReplayMemory     uint64
+	SpoolDir            string
+	SpoolRetention      time.Duration
+	MaxSpoolBytes       uint64
+	SlowPullerPolicy    string
+	MaxSpillBytes       uint64
+	MaxSpillTotal       uint64
+	MaxRate             uint64
+	MaxConnectionRate   uint64
+	LimitRate           uint64
+	ClipboardFile       string
+	AdminSocket         string
+	HealthListen        string
+	Compression         string
+	MaxDecompressedSize int64
 }
 
 func expandConfigFile(path string) string {
@@ -74,7 +105,7 @@ func expandConfigFile(path string) string {
 
 func version() {
 	fmt.Printf("\nPiknik v%v (protocol version: %v)\n",
-		Version, DefaultClientVersion)
+		Version, client.ProtocolVersion)
 }
 
 func confCheck(conf Conf, isServer bool) {
@@ -113,7 +144,34 @@ func main() {
 	isMove := flag.Bool("move", false, "retrieve and delete the clipboard content")
 	isPush := flag.Bool("push", false, "stream stdin to connected pullers")
 	isPull := flag.Bool("pull", false, "wait and receive one stream to stdout")
+	waitPullers := flag.Uint("wait-pullers", 0, "with -push, wait until at least this number of clients are ready to receive the stream")
+	isStore := flag.Bool("store", false, "with -push, let the server store the stream for clients that start pulling later - with -pull, receive the stored stream if there is one")
+	replay := flag.Duration("replay", 0, "with -push, let clients that start pulling within this duration receive the stream from the beginning (e.g. 1m)")
+	isAck := flag.Bool("ack", false, "with -push, wait until every puller has verified the stream, and fail if any of them didn't")
+	waitTimeout := flag.Duration("wait-timeout", 10*time.Minute, "with -wait-pullers, maximum time to wait for clients to be ready")
+	retries := flag.Uint("retries", 0, "with -copy or -pull, number of times to reconnect and resume the transfer if the connection is lost")
 	cidFlag := flag.String("cid", "", "content identifier label for stream binding")
+	isWatch := flag.Bool("watch", false, "wait for new clipboard content and print each item as it is copied")
+	waitFlag := flag.Duration("wait", 0, "when pasting, wait up to this duration for new content to be copied (e.g. 5m)")
+	execCommand := flag.String("exec", "", "with -watch, run a command for each item, with the content on its standard input")
+	isSync := flag.Bool("sync", false, "keep the local desktop clipboard in sync with the Piknik clipboard")
+	syncBackend := flag.String("sync-backend", "auto", "local clipboard used by -sync: auto, wayland, x11, macos or file:<path>")
+	isTunnel := flag.Bool("tunnel", false, "open a bidirectional pipe with another client using -tunnel: stdin is sent to it, and what it sends is written to stdout")
+	forward := flag.String("forward", "", "listen on a local address, and tunnel connections to the service exposed by a client using -expose (e.g. 127.0.0.1:2222)")
+	expose := flag.String("expose", "", "connect clients using -forward to a service reachable from this host (e.g. 127.0.0.1:22)")
+	isShareShell := flag.Bool("share-shell", false, "run a shell, and stream its terminal to clients using -attach")
+	isAttach := flag.Bool("attach", false, "watch a shell shared with -share-shell - Ctrl-] detaches")
+	readWrite := flag.Bool("rw", false, "with -share-shell, let attached clients type into the shell")
+	isClear := flag.Bool("clear", false, "delete the clipboard content")
+	isStatus := flag.Bool("status", false, "print the size and age of the clipboard content without retrieving it")
+	isInfo := flag.Bool("info", false, "print the metadata of the clipboard content instead of the content itself")
+	nameFlag := flag.String("name", "", "file name to record in the content metadata")
+	mimeTypeFlag := flag.String("type", "", "MIME type to record in the content metadata (default=guessed)")
+	isCopyFile := flag.Bool("copy-file", false, "copy (or push, with -push) the files and directories given as arguments")
+	outputFile := flag.String("o", "", "when pasting, moving or pulling, write the content to this file once it has been received and verified, instead of the standard output")
+	pasteTo := flag.String("paste-to", "", "extract files copied with -copy-file into a directory")
+	compression := flag.String("compress", "", "compress the content before encryption: none, gzip, zstd or auto (default=none)")
+	isPing := flag.Bool("ping", false, "check that the server is reachable and accepts the configured keys")
 	isServer := flag.Bool("server", false, "start a server")
 	isGenKeys := flag.Bool("genkeys", false, "generate keys")
 	isDeterministic := flag.Bool("password", false, "derive the keys from a password (default=random keys)")
@@ -121,7 +179,10 @@ func main() {
 	maxLenMb := flag.Uint64("maxlen", 0, "maximum content length to accept in Mb (0=unlimited)")
 	timeout := flag.Uint("timeout", 10, "connection timeout (seconds)")
 	dataTimeout := flag.Uint("datatimeout", 3600, "data transmission timeout (seconds)")
+	limitRate := flag.String("limit-rate", "", "maximum bandwidth to use, in bytes per second, with an optional K, M or G suffix (e.g. 5M)")
+	isStats := flag.Bool("stats", false, "when copying, pasting, moving, pushing or pulling, print statistics about the transfer to stderr once it is complete")
 	isVersion := flag.Bool("version", false, "display package version")
+	adminCommand := flag.String("admin", "", "send a command to the admin socket of a local server (status, clear, clients, pullers, abort, config)")
 
 	defaultConfigFile := "~/.piknik.toml"
 	if runtime.GOOS == "windows" {
@@ -185,7 +246,7 @@ func main() {
 		binary.LittleEndian.PutUint64(conf.EncryptSkID, encryptSkID)
 	} else if len(conf.EncryptSk) > 0 {
 		hf, _ := blake2b.New(&blake2b.Config{
-			Person: []byte(DomainStr),
+			Person: []byte(protocol.DomainStr),
 			Size:   8,
 		})
 		hf.Write(conf.EncryptSk)
@@ -222,18 +283,106 @@ func main() {
 	if conf.TrustedIPCount < 1 {
 		conf.TrustedIPCount = 1
 	}
-	conf.MaxStreamBytes = DefaultMaxStreamBytes
+	conf.MaxWatchers = server.DefaultMaxWatchers
+	if tomlConf.MaxWatchers > 0 {
+		conf.MaxWatchers = tomlConf.MaxWatchers
+	}
+	conf.MaxStreamBytes = client.DefaultMaxStreamBytes
 	if tomlConf.MaxStreamBytes > 0 {
 		conf.MaxStreamBytes = tomlConf.MaxStreamBytes
 	}
-	conf.MaxStreamDuration = DefaultMaxStreamDur
+	conf.MaxStreamDuration = client.DefaultMaxStreamDur
 	if tomlConf.MaxStreamDuration > 0 {
 		conf.MaxStreamDuration = time.Duration(tomlConf.MaxStreamDuration) * time.Second
 	}
-	conf.MaxWaitingPullers = DefaultMaxWaitPullers
+	conf.MaxWaitingPullers = server.DefaultMaxWaitPullers
 	if tomlConf.MaxWaitingPullers > 0 {
 		conf.MaxWaitingPullers = tomlConf.MaxWaitingPullers
 	}
+	conf.MaxReplayBytes = server.DefaultMaxReplayBytes
+	if tomlConf.MaxReplayBytes > 0 {
+		conf.MaxReplayBytes = tomlConf.MaxReplayBytes
+	}
+	conf.MaxReplayMemory = max(server.DefaultMaxReplayMemory, conf.MaxReplayBytes)
+	if tomlConf.MaxReplayMemory > 0 {
+		conf.MaxReplayMemory = tomlConf.MaxReplayMemory
+	}
+	if tomlConf.SpoolDir != "" {
+		conf.SpoolDir = expandConfigFile(tomlConf.SpoolDir)
+	}
+	conf.SpoolRetention = server.DefaultSpoolRetention
+	if tomlConf.SpoolRetention > 0 {
+		conf.SpoolRetention = time.Duration(tomlConf.SpoolRetention) * time.Second
+	}
+	conf.MaxSpoolBytes = server.DefaultMaxSpoolBytes
+	if tomlConf.MaxSpoolBytes > 0 {
+		conf.MaxSpoolBytes = tomlConf.MaxSpoolBytes
+	}
+	conf.SlowPullerPolicy = server.SlowPullerBlock
+	if tomlConf.SlowPullerPolicy != "" {
+		conf.SlowPullerPolicy = tomlConf.SlowPullerPolicy
+	}
+	if !server.ValidSlowPullerPolicy(conf.SlowPullerPolicy) {
+		log.Fatalf("Unsupported slow puller policy [%v] - Use block, drop or spill", conf.SlowPullerPolicy)
+	}
+	conf.MaxSpillBytes = server.DefaultMaxSpillBytes
+	if tomlConf.MaxSpillBytes > 0 {
+		conf.MaxSpillBytes = tomlConf.MaxSpillBytes
+	}
+	conf.MaxSpillTotal = server.DefaultMaxSpillTotal
+	if tomlConf.MaxSpillTotal > 0 {
+		conf.MaxSpillTotal = tomlConf.MaxSpillTotal
+	}
+	conf.MaxRate = tomlConf.MaxRate
+	conf.MaxConnectionRate = tomlConf.MaxConnectionRate
+	if tomlConf.ClipboardFile != "" {
+		conf.ClipboardFile = expandConfigFile(tomlConf.ClipboardFile)
+	}
+	if *limitRate != "" {
+		if conf.LimitRate, err = ratelimit.ParseRate(*limitRate); err != nil {
+			log.Fatalf("Invalid rate [%v] - Use a number of bytes per second, with an optional K, M or G suffix", *limitRate)
+		}
+	}
+	conf.HealthListen = tomlConf.HealthListen
+	conf.Compression = "none"
+	if tomlConf.Compression != "" {
+		conf.Compression = tomlConf.Compression
+	}
+	if *compression != "" {
+		conf.Compression = *compression
+	}
+	if !client.ValidCompressionMode(conf.Compression) {
+		log.Fatalf("Unsupported compression mode [%v] - Use none, gzip, zstd or auto", conf.Compression)
+	}
+	conf.MaxDecompressedSize = client.DefaultMaxDecompressedSize
+	if tomlConf.MaxDecompressedSize > 0 {
+		conf.MaxDecompressedSize = tomlConf.MaxDecompressedSize
+	}
+	if tomlConf.AdminSocket != "" {
+		conf.AdminSocket = expandConfigFile(tomlConf.AdminSocket)
+	}
+	if *adminCommand != "" {
+		if conf.AdminSocket == "" {
+			log.Fatal("Configuration error: the AdminSocket property is required in order to use -admin")
+		}
+		RunAdmin(conf, *adminCommand)
+		return
+	}
+
+	var files []string
+	if *isCopyFile {
+		files = flag.Args()
+		if len(files) == 0 {
+			log.Fatal("-copy-file requires at least one file or directory")
+		}
+		if !*isPush {
+			*isCopy = true
+		}
+	}
+	if *pasteTo != "" && (*isCopy || *isPush || *isWatch || *isSync || *isTunnel || *forward != "" || *expose != "" ||
+		*isShareShell || *isAttach) {
+		log.Fatal("-paste-to can only be used to paste, move or pull")
+	}
 
 	modeCount := 0
 	if *isCopy {
@@ -248,8 +397,83 @@ func main() {
 	if *isPull {
 		modeCount++
 	}
+	if *isPing {
+		modeCount++
+	}
+	if *isStatus {
+		modeCount++
+	}
+	if *isClear {
+		modeCount++
+	}
+	if *isWatch {
+		modeCount++
+	}
+	if *isSync {
+		modeCount++
+	}
+	if *isTunnel {
+		modeCount++
+	}
+	if *forward != "" {
+		modeCount++
+	}
+	if *expose != "" {
+		modeCount++
+	}
+	if *isShareShell {
+		modeCount++
+	}
+	if *isAttach {
+		modeCount++
+	}
 	if modeCount > 1 {
-		log.Fatal("Only one of -copy, -move, -push, -pull can be specified")
+		log.Fatal("Only one of -copy, -move, -push, -pull, -ping, -status, -clear, -watch, -sync, -tunnel, -forward, -expose, -share-shell, -attach can be specified")
+	}
+	if *isStats && modeCount > 0 && !*isCopy && !*isMove && !*isPush && !*isPull {
+		log.Fatal("-stats can only be used to copy, paste, move, push or pull")
+	}
+	if *outputFile != "" && ((modeCount > 0 && !*isMove && !*isPull) || *pasteTo != "" || *isInfo) {
+		log.Fatal("-o can only be used to paste, move or pull")
+	}
+	if *isInfo && (*pasteTo != "" || (modeCount > 0 && !*isWatch)) {
+		log.Fatal("-info can only be used to paste or watch")
+	}
+	if *waitFlag < 0 || *waitFlag > protocol.MaxWaitDuration {
+		log.Fatalf("-wait must be between 0 and %v", protocol.MaxWaitDuration)
+	}
+	if *waitFlag > 0 && modeCount > 0 && !*isMove {
+		log.Fatal("-wait can only be used to paste or move")
+	}
+	if *waitPullers > 0 && !*isPush {
+		log.Fatal("-wait-pullers can only be used with -push")
+	}
+	if *waitPullers > math.MaxUint32 {
+		log.Fatal("-wait-pullers is too large")
+	}
+	if *isStore && !*isPush && !*isPull {
+		log.Fatal("-store can only be used with -push or -pull")
+	}
+	if *isAck && !*isPush {
+		log.Fatal("-ack can only be used with -push")
+	}
+	if *replay != 0 && !*isPush {
+		log.Fatal("-replay can only be used with -push")
+	}
+	if *replay < 0 || *replay > protocol.MaxWaitDuration {
+		log.Fatalf("-replay must be between 0 and %v", protocol.MaxWaitDuration)
+	}
+	if *waitTimeout < time.Second || *waitTimeout > protocol.MaxWaitDuration {
+		log.Fatalf("-wait-timeout must be between 1s and %v", protocol.MaxWaitDuration)
+	}
+	if *retries > 0 && !*isCopy && !*isPull {
+		log.Fatal("-retries can only be used with -copy or -pull")
+	}
+	if *readWrite && !*isShareShell {
+		log.Fatal("-rw can only be used with -share-shell")
+	}
+	if *execCommand != "" && !*isWatch {
+		log.Fatal("-exec can only be used with -watch")
 	}
 
 	cid := *cidFlag
@@ -263,7 +487,45 @@ func main() {
 	confCheck(conf, *isServer)
 	if *isServer {
 		RunServer(conf)
+	} else if *isPing {
+		RunPing(conf)
+	} else if *isSync {
+		RunSync(conf, *syncBackend)
+	} else if *isTunnel {
+		RunTunnel(conf, cid)
+	} else if *forward != "" {
+		RunForward(conf, cid, *forward)
+	} else if *expose != "" {
+		RunExpose(conf, cid, *expose)
+	} else if *isShareShell {
+		RunShareShell(conf, cid, *readWrite)
+	} else if *isAttach {
+		RunAttach(conf, cid)
 	} else {
-		RunClient(conf, *isCopy, *isMove, *isPush, *isPull, cid)
+		RunClient(conf, ClientOptions{
+			IsCopy:      *isCopy,
+			IsMove:      *isMove,
+			IsPush:      *isPush,
+			IsPull:      *isPull,
+			IsInfo:      *isInfo,
+			IsStatus:    *isStatus,
+			IsClear:     *isClear,
+			IsWatch:     *isWatch,
+			Exec:        *execCommand,
+			Wait:        *waitFlag,
+			WaitPullers: uint32(*waitPullers),
+			WaitTimeout: *waitTimeout,
+			Replay:      *replay,
+			Store:       *isStore,
+			Ack:         *isAck,
+			Output:      *outputFile,
+			Stats:       *isStats,
+			Retries:     *retries,
+			CID:         cid,
+			Name:        *nameFlag,
+			MIMEType:    *mimeTypeFlag,
+			Files:       files,
+			PasteTo:     *pasteTo,
+		})
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+)
+
+// Transfers report their progress on the standard error when it is a
+// terminal. The progress is only drawn once a transfer has been running for a
+// little while, so that quick transfers remain silent. A nil progress reports
+// nothing.
+
+const (
+	progressInterval = 200 * time.Millisecond
+	progressDelay    = time.Second
+	progressBarWidth = 20
+)
+
+// transferProgress - Amount of data transferred so far. bytes is what the
+// client library reports, and content is the size of the content itself, as
+// read from the input or written to the output, which is what the statistics
+// report.
+type transferProgress struct {
+	operation string
+	start     atomic.Int64
+	total     atomic.Uint64
+	bytes     atomic.Uint64
+	chunks    atomic.Uint64
+	content   atomic.Uint64
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newTransferProgress(operation string, show bool) *transferProgress {
+	progress := &transferProgress{
+		operation: operation,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	progress.Begin()
+	if !show {
+		close(progress.stopped)
+		return progress
+	}
+	go func() {
+		defer close(progress.stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		drawn := false
+		for {
+			select {
+			case <-ticker.C:
+				if progress.elapsed() >= progressDelay {
+					fmt.Fprintf(os.Stderr, "\r\x1b[K%v", progress.line())
+					drawn = true
+				}
+			case <-progress.done:
+				if drawn {
+					os.Stderr.WriteString("\r\x1b[K")
+				}
+				return
+			}
+		}
+	}()
+	return progress
+}
+
+// Begin - Starts measuring the transfer, once data is about to be exchanged
+func (progress *transferProgress) Begin() {
+	if progress != nil {
+		progress.start.Store(time.Now().UnixNano())
+		progress.bytes.Store(0)
+		progress.chunks.Store(0)
+	}
+}
+
+func (progress *transferProgress) elapsed() time.Duration {
+	return time.Duration(time.Now().UnixNano() - progress.start.Load())
+}
+
+// SetTotal - Sets the expected number of bytes, if it is known
+func (progress *transferProgress) SetTotal(total uint64) {
+	if progress != nil {
+		progress.total.Store(total)
+	}
+}
+
+// Add - Records transferred bytes and chunks
+func (progress *transferProgress) Add(bytes uint64, chunks uint64) {
+	if progress != nil {
+		progress.bytes.Add(bytes)
+		progress.chunks.Add(chunks)
+	}
+}
+
+// Restart - Sets the number of bytes transferred so far, when a transfer is
+// resumed
+func (progress *transferProgress) Restart(bytes uint64) {
+	if progress != nil {
+		progress.bytes.Store(bytes)
+	}
+}
+
+// finish - Stops drawing the progress
+func (progress *transferProgress) finish() {
+	if progress != nil {
+		close(progress.done)
+		<-progress.stopped
+	}
+}
+
+func (progress *transferProgress) line() string {
+	bytes, total := progress.bytes.Load(), progress.total.Load()
+	rate := float64(bytes) / progress.elapsed().Seconds()
+	var line strings.Builder
+	line.WriteString(progress.operation)
+	if total > 0 {
+		filled := int(min(bytes, total) * progressBarWidth / total)
+		fmt.Fprintf(&line, " [%v%v] %v / %v (%v%%)",
+			strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled),
+			formatBytes(bytes), formatBytes(total), min(bytes, total)*100/total)
+	} else {
+		fmt.Fprintf(&line, " %v", formatBytes(bytes))
+	}
+	fmt.Fprintf(&line, "  %v/s", formatBytes(uint64(rate)))
+	if total > bytes && rate > 0 {
+		eta := time.Duration(float64(total-bytes) / rate * float64(time.Second))
+		fmt.Fprintf(&line, "  ETA %v", eta.Round(time.Second))
+	}
+	return line.String()
+}
+
+// printStats - Prints a summary of the transfer, as key=value pairs
+func (progress *transferProgress) printStats(out io.Writer) {
+	if progress == nil {
+		return
+	}
+	duration := progress.elapsed()
+	bytes := progress.content.Load()
+	fmt.Fprintf(out, "operation=%v bytes=%v chunks=%v duration=%.3f throughput=%.0f\n",
+		progress.operation, bytes, progress.chunks.Load(), duration.Seconds(),
+		float64(bytes)/duration.Seconds())
+}
+
+// reader - Counts the content read from r
+func (progress *transferProgress) reader(r io.Reader) io.Reader {
+	if progress == nil {
+		return r
+	}
+	return &contentCounter{r: r, progress: progress}
+}
+
+// writer - Counts the content written to w
+func (progress *transferProgress) writer(w io.Writer) io.Writer {
+	if progress == nil {
+		return w
+	}
+	return &contentCounter{w: w, progress: progress}
+}
+
+type contentCounter struct {
+	r        io.Reader
+	w        io.Writer
+	progress *transferProgress
+}
+
+// Stat - Returns information about the input, so that the client library
+// can record the size and permissions of a file
+func (cc *contentCounter) Stat() (os.FileInfo, error) {
+	if file, ok := cc.r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		return file.Stat()
+	}
+	return nil, errors.New("Not a file")
+}
+
+func (cc *contentCounter) Read(p []byte) (int, error) {
+	n, err := cc.r.Read(p)
+	cc.progress.content.Add(uint64(n))
+	return n, err
+}
+
+func (cc *contentCounter) Write(p []byte) (int, error) {
+	n, err := cc.w.Write(p)
+	cc.progress.content.Add(uint64(n))
+	return n, err
+}
+
+// asProgress - Progress passed to the client library, nil if the progress
+// isn't reported
+func (progress *transferProgress) asProgress() client.Progress {
+	if progress == nil {
+		return nil
+	}
+	return progress
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// clipboard - The content kept in the store, and a channel that is closed
+// whenever it changes
+type clipboard struct {
+	sync.Mutex
+
+	store     Store
+	changedCh chan struct{}
+}
+
+// get - Returns the content, or nil if the clipboard is empty. If isMove is
+// set, the content is also removed from the store.
+func (cb *clipboard) get(isMove bool) (*Content, error) {
+	cb.Lock()
+	defer cb.Unlock()
+	content, err := cb.store.Load()
+	if err != nil || content == nil || !isMove {
+		return content, err
+	}
+	if err := cb.store.Delete(); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// update - Replaces the content, and notifies waiting clients
+func (cb *clipboard) update(ts []byte, signature []byte, ciphertextWithEncryptSkIDAndNonce []byte) error {
+	cb.Lock()
+	defer cb.Unlock()
+	err := cb.store.Save(&Content{
+		Ts:         ts,
+		Signature:  signature,
+		Ciphertext: ciphertextWithEncryptSkIDAndNonce,
+		StoredAt:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	close(cb.changedCh)
+	cb.changedCh = make(chan struct{})
+	return nil
+}
+
+// clear - Removes the content. Returns false if the clipboard was already
+// empty.
+func (cb *clipboard) clear() (bool, error) {
+	cb.Lock()
+	defer cb.Unlock()
+	content, err := cb.store.Load()
+	if err != nil || content == nil {
+		return false, err
+	}
+	if err := cb.store.Delete(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Clipboard - Returns the clipboard content, or nil if the clipboard is empty
+func (srv *Server) Clipboard() (*Content, error) {
+	return srv.clipboard.get(false)
+}
+
+// Clear - Removes the clipboard content. Returns false if the clipboard was
+// already empty.
+func (srv *Server) Clear() (bool, error) {
+	return srv.clipboard.clear()
+}
+
+func (cnx *connection) getOperation(h1 []byte, isMove bool) {
+	conf, reader := cnx.conf, cnx.reader
+	rbuf := make([]byte, 32)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	h2 := rbuf
+	opcode := byte('G')
+	if isMove {
+		opcode = byte('M')
+	}
+	wh2 := protocol.Auth2Get(conf.Psk, cnx.clientVersion, h1, opcode)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return
+	}
+
+	content, err := cnx.srv.clipboard.get(isMove)
+	if err != nil {
+		cnx.srv.log(err)
+		return
+	}
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	if _, err := cnx.sendContent(h2, content); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+}
+
+// sendContent - Sends the content, or an empty response if content is nil
+func (cnx *connection) sendContent(h2 []byte, content *Content) ([]byte, error) {
+	conf, writer := cnx.conf, cnx.writer
+	var ts, signature, ciphertextWithEncryptSkIDAndNonce []byte
+	if content != nil {
+		ts, signature, ciphertextWithEncryptSkIDAndNonce = content.Ts, content.Signature, content.Ciphertext
+	}
+	h3 := protocol.Auth3Get(conf.Psk, cnx.clientVersion, h2, ts, signature)
+	writer.Write(h3)
+	ciphertextWithEncryptSkIDAndNonceLen := uint64(len(ciphertextWithEncryptSkIDAndNonce))
+	binary.Write(writer, binary.LittleEndian, ciphertextWithEncryptSkIDAndNonceLen)
+	writer.Write(ts)
+	writer.Write(signature)
+	writer.Write(ciphertextWithEncryptSkIDAndNonce)
+	return h3, writer.Flush()
+}
+
+func (cnx *connection) waitGetOperation(h1 []byte) {
+	conf, reader := cnx.conf, cnx.reader
+	rbuf := make([]byte, 32+1+8)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	h2 := rbuf[0:32]
+	flags := rbuf[32]
+	timeoutBytes := rbuf[33:41]
+	opcode := byte('N')
+	wh2 := protocol.Auth2Wait(conf.Psk, cnx.clientVersion, h1, opcode, flags, timeoutBytes)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return
+	}
+	isMove := flags&protocol.WaitFlagMove != 0
+	timeout := time.Duration(binary.LittleEndian.Uint64(timeoutBytes)) * time.Second
+	if timeout > protocol.MaxWaitDuration {
+		timeout = protocol.MaxWaitDuration
+	}
+	arrival := time.Now()
+	cnx.conn.SetDeadline(arrival.Add(timeout + conf.Timeout))
+
+	gone := make(chan struct{})
+	go func() {
+		reader.ReadByte()
+		close(gone)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	cb := &cnx.srv.clipboard
+	var newContent *Content
+wait:
+	for {
+		cb.Lock()
+		content, err := cb.store.Load()
+		isNew := content != nil && content.StoredAt.After(arrival)
+		if isNew {
+			newContent = content
+			if isMove {
+				err = cb.store.Delete()
+			}
+		}
+		changedCh := cb.changedCh
+		cb.Unlock()
+		if err != nil {
+			cnx.srv.log(err)
+			return
+		}
+		if isNew {
+			break
+		}
+		select {
+		case <-changedCh:
+		case <-gone:
+			return
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	if _, err := cnx.sendContent(h2, newContent); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+}
+
+func (cnx *connection) storeOperation(h1 []byte) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	rbuf := make([]byte, 112)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	h2 := rbuf[0:32]
+	ciphertextWithEncryptSkIDAndNonceLen := binary.LittleEndian.Uint64(rbuf[32:40])
+	if ciphertextWithEncryptSkIDAndNonceLen < 8+24 {
+		cnx.srv.logf("Short encrypted message (only %v bytes)\n", ciphertextWithEncryptSkIDAndNonceLen)
+		return
+	}
+	if conf.MaxLen > 0 && ciphertextWithEncryptSkIDAndNonceLen > conf.MaxLen {
+		cnx.srv.logf("%v bytes requested to be stored, but limit set to %v bytes (%v Mb)\n",
+			ciphertextWithEncryptSkIDAndNonceLen, conf.MaxLen, conf.MaxLen/(1024*1024))
+		return
+	}
+	var ts, signature []byte
+	ts = rbuf[40:48]
+	signature = rbuf[48:112]
+	opcode := byte('S')
+
+	wh2 := protocol.Auth2Store(conf.Psk, cnx.clientVersion, h1, opcode, ts, signature)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return
+	}
+	ciphertextWithEncryptSkIDAndNonce := make([]byte, ciphertextWithEncryptSkIDAndNonceLen)
+
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	if _, err := io.ReadFull(reader, ciphertextWithEncryptSkIDAndNonce); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	if !ed25519.Verify(conf.SignPk, ciphertextWithEncryptSkIDAndNonce, signature) {
+		return
+	}
+	h3 := protocol.Auth3Store(conf.Psk, h2)
+
+	if err := cnx.srv.clipboard.update(ts, signature, ciphertextWithEncryptSkIDAndNonce); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+
+	writer.Write(h3)
+	if err := writer.Flush(); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+}
+
+func (cnx *connection) watchOperation(h1 []byte) {
+	conf, reader := cnx.conf, cnx.reader
+	rbuf := make([]byte, 32)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	h2 := rbuf
+	opcode := byte('W')
+	wh2 := protocol.Auth2Get(conf.Psk, cnx.clientVersion, h1, opcode)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return
+	}
+	if !cnx.srv.startWatching() {
+		cnx.srv.logf("Too many clients are watching the clipboard (limit: %v)\n", conf.MaxWatchers)
+		return
+	}
+	defer cnx.srv.stopWatching()
+
+	gone := make(chan struct{})
+	go func() {
+		cnx.conn.SetReadDeadline(time.Time{})
+		reader.ReadByte()
+		close(gone)
+	}()
+
+	cb := &cnx.srv.clipboard
+	cb.Lock()
+	changedCh := cb.changedCh
+	cb.Unlock()
+	for {
+		cnx.conn.SetWriteDeadline(time.Time{})
+		select {
+		case <-changedCh:
+		case <-gone:
+			return
+		}
+		cb.Lock()
+		content, err := cb.store.Load()
+		changedCh = cb.changedCh
+		cb.Unlock()
+		if err != nil {
+			cnx.srv.log(err)
+			return
+		}
+		if content == nil {
+			continue
+		}
+
+		cnx.conn.SetWriteDeadline(time.Now().Add(conf.DataTimeout))
+		h3, err := cnx.sendContent(h2, content)
+		if err != nil {
+			cnx.srv.log(err)
+			return
+		}
+		h2 = h3
+	}
+}
+
+func (cnx *connection) infoOperation(h1 []byte) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	rbuf := make([]byte, 32)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	h2 := rbuf
+	opcode := byte('I')
+	wh2 := protocol.Auth2Get(conf.Psk, cnx.clientVersion, h1, opcode)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return
+	}
+
+	content, err := cnx.srv.clipboard.get(false)
+	if err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	ts, contentLen, encryptSkID, signature := make([]byte, 8), make([]byte, 8), make([]byte, 8), make([]byte, 64)
+	if content != nil {
+		copy(ts, content.Ts)
+		binary.LittleEndian.PutUint64(contentLen, uint64(len(content.Ciphertext)))
+		copy(encryptSkID, content.Ciphertext[0:8])
+		copy(signature, content.Signature)
+	}
+
+	h3 := protocol.Auth3Info(conf.Psk, h2, ts, contentLen, encryptSkID, signature)
+	writer.Write(h3)
+	writer.Write(ts)
+	writer.Write(contentLen)
+	writer.Write(encryptSkID)
+	writer.Write(signature)
+	if err := writer.Flush(); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+}
+
+func (cnx *connection) clearOperation(h1 []byte) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	rbuf := make([]byte, 32)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	h2 := rbuf
+	opcode := byte('D')
+	wh2 := protocol.Auth2Get(conf.Psk, cnx.clientVersion, h1, opcode)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return
+	}
+	if _, err := cnx.srv.clipboard.clear(); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+
+	h3 := protocol.Auth3Store(conf.Psk, h2)
+	writer.Write(h3)
+	if err := writer.Flush(); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Frames relayed to a puller are queued in memory. When a puller receives
+// them slower than they are pushed and its queue is full, the slow puller
+// policy of the server applies: "block" waits for the puller, slowing down the
+// pusher and every other puller, "drop" disconnects the puller if its queue is
+// still full after a few seconds, and "spill" queues the following frames to a
+// temporary file until the puller catches up. A puller whose spill file would
+// exceed MaxSpillBytes, or make all the spill files exceed MaxSpillTotal, is
+// disconnected. Every spilled frame is prefixed with its length, so that it is
+// read back as a whole.
+
+const (
+	// SlowPullerBlock - Wait for slow pullers
+	SlowPullerBlock = "block"
+	// SlowPullerDrop - Disconnect pullers that are too slow
+	SlowPullerDrop = "drop"
+	// SlowPullerSpill - Queue frames to disk for slow pullers
+	SlowPullerSpill = "spill"
+
+	maxQueuedFrames   = 64
+	slowPullerTimeout = 5 * time.Second
+)
+
+var (
+	errPullerDropped = errors.New("Puller dropped for being too slow")
+	errSpillFull     = errors.New("Spill limit reached")
+)
+
+type subscriber struct {
+	mu         sync.Mutex
+	frames     [][]byte
+	queued     uint64
+	spill      *os.File
+	spillRead  int64
+	spillWrite int64
+	spilled    uint64
+	spillTotal *atomic.Int64
+	closed     bool
+	dropped    bool
+	ready      chan struct{}
+	space      chan struct{}
+	done       chan struct{}
+	ack        chan []byte
+	ackWanted  bool
+	delivered  atomic.Uint64
+	remoteAddr net.Addr
+	since      time.Time
+	waiting    bool
+}
+
+// ValidSlowPullerPolicy - Whether a slow puller policy is supported
+func ValidSlowPullerPolicy(policy string) bool {
+	switch policy {
+	case SlowPullerBlock, SlowPullerDrop, SlowPullerSpill:
+		return true
+	}
+	return false
+}
+
+// newSubscriber - Creates a subscriber. spillTotal is the size of all the
+// spill files of the server.
+func newSubscriber(remoteAddr net.Addr, waiting bool, spillTotal *atomic.Int64) *subscriber {
+	return &subscriber{
+		ready:      make(chan struct{}, 1),
+		space:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		ack:        make(chan []byte, 1),
+		remoteAddr: remoteAddr,
+		since:      time.Now(),
+		waiting:    waiting,
+		spillTotal: spillTotal,
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// send - Queues a frame according to the slow puller policy. Returns false
+// if the puller is gone or has been dropped.
+func (sub *subscriber) send(conf Config, frame []byte) bool {
+	var deadline <-chan time.Time
+	for {
+		sub.mu.Lock()
+		if sub.closed {
+			sub.mu.Unlock()
+			return false
+		}
+		spillEmpty := sub.spillRead == sub.spillWrite
+		if spillEmpty && len(sub.frames) < maxQueuedFrames {
+			sub.frames = append(sub.frames, frame)
+			sub.queued += uint64(len(frame))
+			sub.mu.Unlock()
+			notify(sub.ready)
+			return true
+		}
+		switch conf.SlowPullerPolicy {
+		case SlowPullerDrop:
+			if deadline == nil {
+				timer := time.NewTimer(slowPullerTimeout)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+		case SlowPullerSpill:
+			err := sub.spillFrame(conf, frame)
+			if err != nil {
+				sub.dropped, sub.closed = true, true
+			}
+			sub.mu.Unlock()
+			notify(sub.ready)
+			return err == nil
+		}
+		sub.mu.Unlock()
+		select {
+		case <-sub.space:
+		case <-sub.done:
+			return false
+		case <-deadline:
+			sub.mu.Lock()
+			sub.dropped, sub.closed = true, true
+			sub.mu.Unlock()
+			notify(sub.ready)
+			return false
+		}
+	}
+}
+
+// spillFrame - Appends a frame, prefixed with its length, to the spill file.
+// The subscriber must be locked.
+func (sub *subscriber) spillFrame(conf Config, frame []byte) error {
+	frameLen := int64(4 + len(frame))
+	if uint64(sub.spillWrite+frameLen) > conf.MaxSpillBytes {
+		return errSpillFull
+	}
+	if uint64(sub.spillTotal.Add(frameLen)) > conf.MaxSpillTotal {
+		sub.spillTotal.Add(-frameLen)
+		return errSpillFull
+	}
+	if sub.spill == nil {
+		dir := conf.SpoolDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		spill, err := os.CreateTemp(dir, "piknik-spill-*")
+		if err != nil {
+			sub.spillTotal.Add(-frameLen)
+			return err
+		}
+		sub.spill = spill
+	}
+	prefixed := binary.LittleEndian.AppendUint32(make([]byte, 0, frameLen), uint32(len(frame)))
+	if _, err := sub.spill.WriteAt(append(prefixed, frame...), sub.spillWrite); err != nil {
+		sub.spillTotal.Add(-frameLen)
+		return err
+	}
+	sub.spillWrite += frameLen
+	sub.spilled += uint64(len(frame))
+	return nil
+}
+
+// next - Returns the next frame to send to the puller, waiting for it if
+// necessary. Frames read back from the spill file are stored in buf, that
+// must be large enough for any frame. Returns io.EOF once the stream has
+// ended and every frame has been returned, or errPullerDropped if the puller
+// has been dropped.
+func (sub *subscriber) next(buf []byte) ([]byte, error) {
+	for {
+		sub.mu.Lock()
+		if sub.dropped {
+			sub.mu.Unlock()
+			return nil, errPullerDropped
+		}
+		if len(sub.frames) > 0 {
+			frame := sub.frames[0]
+			sub.frames[0] = nil
+			sub.frames = sub.frames[1:]
+			sub.queued -= uint64(len(frame))
+			sub.mu.Unlock()
+			notify(sub.space)
+			return frame, nil
+		}
+		if sub.spillRead < sub.spillWrite {
+			frame, err := sub.readSpilledFrame(buf)
+			if err == nil && sub.spillRead == sub.spillWrite {
+				sub.spillTotal.Add(-sub.spillWrite)
+				sub.spillRead, sub.spillWrite = 0, 0
+				err = sub.spill.Truncate(0)
+			}
+			sub.mu.Unlock()
+			return frame, err
+		}
+		if sub.closed {
+			sub.mu.Unlock()
+			return nil, io.EOF
+		}
+		sub.mu.Unlock()
+		<-sub.ready
+	}
+}
+
+// readSpilledFrame - Reads the next frame of the spill file into buf. The
+// subscriber must be locked.
+func (sub *subscriber) readSpilledFrame(buf []byte) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := sub.spill.ReadAt(prefix[:], sub.spillRead); err != nil {
+		return nil, err
+	}
+	frameLen := int64(binary.LittleEndian.Uint32(prefix[:]))
+	if frameLen > int64(len(buf)) || sub.spillRead+4+frameLen > sub.spillWrite {
+		return nil, errors.New("Corrupted spill file")
+	}
+	frame := buf[:frameLen]
+	if _, err := sub.spill.ReadAt(frame, sub.spillRead+4); err != nil {
+		return nil, err
+	}
+	sub.spillRead += 4 + frameLen
+	return frame, nil
+}
+
+// lag - Returns the number of bytes queued for the puller, and the total
+// number of bytes that have been spilled to disk
+func (sub *subscriber) lag() (uint64, uint64) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.queued + uint64(sub.spillWrite-sub.spillRead), sub.spilled
+}
+
+// close - Signals the end of the stream
+func (sub *subscriber) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+	notify(sub.ready)
+}
+
+// requestAck - Asks the puller to acknowledge the stream once it has received
+// the end frame, and signals the end of the stream
+func (sub *subscriber) requestAck() {
+	sub.mu.Lock()
+	sub.ackWanted, sub.closed = true, true
+	sub.mu.Unlock()
+	notify(sub.ready)
+}
+
+// ackRequested - Whether the pusher waits for the puller to acknowledge the
+// stream
+func (sub *subscriber) ackRequested() bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.ackWanted
+}
+
+// waitAck - Returns the acknowledgement of the puller, or nil if it left
+// without acknowledging the stream
+func (sub *subscriber) waitAck() []byte {
+	select {
+	case ack := <-sub.ack:
+		return ack
+	case <-sub.done:
+	}
+	select {
+	case ack := <-sub.ack:
+		return ack
+	default:
+		return nil
+	}
+}
+
+// release - Called once the puller is gone
+func (sub *subscriber) release() {
+	sub.mu.Lock()
+	sub.closed = true
+	if sub.spill != nil {
+		sub.spill.Close()
+		os.Remove(sub.spill.Name())
+		sub.spill = nil
+		sub.spillTotal.Add(-sub.spillWrite)
+		sub.spillRead, sub.spillWrite = 0, 0
+	}
+	sub.mu.Unlock()
+	close(sub.done)
+}
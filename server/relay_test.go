@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSubscriber(spillTotal *atomic.Int64) *subscriber {
+	return newSubscriber(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, false, spillTotal)
+}
+
+func spillConfig(t *testing.T, maxSpillBytes uint64, maxSpillTotal uint64) Config {
+	return Config{
+		SlowPullerPolicy: SlowPullerSpill,
+		SpoolDir:         t.TempDir(),
+		MaxSpillBytes:    maxSpillBytes,
+		MaxSpillTotal:    maxSpillTotal,
+	}
+}
+
+// testFrame - A frame of the given length, filled with its index
+func testFrame(i int, frameLen int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, frameLen)
+}
+
+func TestSubscriberSpill(t *testing.T) {
+	conf := spillConfig(t, 1<<20, 1<<20)
+	var spillTotal atomic.Int64
+	sub := testSubscriber(&spillTotal)
+	defer sub.release()
+
+	// Frame lengths unrelated to each other and to the read buffer, so that
+	// several of them fit in the buffer
+	const maxFrameLen = 1000
+	var sent [][]byte
+	send := func(count int) {
+		for ; count > 0; count-- {
+			i := len(sent)
+			frame := testFrame(i, 1+(i*337)%maxFrameLen)
+			if !sub.send(conf, frame) {
+				t.Fatalf("send() of frame %v failed", i)
+			}
+			sent = append(sent, frame)
+		}
+	}
+	received := 0
+	receive := func(count int) {
+		buf := make([]byte, maxFrameLen)
+		for ; count > 0; count-- {
+			frame, err := sub.next(buf)
+			if err != nil {
+				t.Fatalf("next() = %v after %v frames", err, received)
+			}
+			if !bytes.Equal(frame, sent[received]) {
+				t.Fatalf("frame %v: got %v bytes, want %v", received, len(frame), len(sent[received]))
+			}
+			received++
+		}
+	}
+
+	send(3 * maxQueuedFrames)
+	if _, spilled := sub.lag(); spilled == 0 {
+		t.Fatal("nothing was spilled")
+	}
+	// Frames sent while the spill file isn't empty are spilled after the
+	// others, even if the queue has room
+	receive(maxQueuedFrames + 10)
+	send(20)
+	receive(len(sent) - received)
+
+	sub.close()
+	if _, err := sub.next(make([]byte, maxFrameLen)); err != io.EOF {
+		t.Fatalf("next() = %v at the end of the stream, want %v", err, io.EOF)
+	}
+	if total := spillTotal.Load(); total != 0 {
+		t.Fatalf("spill total = %v once everything was read, want 0", total)
+	}
+}
+
+func TestSubscriberSpillLimit(t *testing.T) {
+	conf := spillConfig(t, 10*(4+100), 1<<20)
+	var spillTotal atomic.Int64
+	sub := testSubscriber(&spillTotal)
+	for i := 0; i < maxQueuedFrames+10; i++ {
+		if !sub.send(conf, testFrame(i, 100)) {
+			t.Fatalf("send() of frame %v failed before the spill file was full", i)
+		}
+	}
+	if sub.send(conf, testFrame(0, 100)) {
+		t.Fatal("send() past MaxSpillBytes should have failed")
+	}
+	if _, err := sub.next(make([]byte, 100)); err != errPullerDropped {
+		t.Fatalf("next() = %v, want %v", err, errPullerDropped)
+	}
+	sub.release()
+	if total := spillTotal.Load(); total != 0 {
+		t.Fatalf("spill total = %v after release(), want 0", total)
+	}
+}
+
+func TestSubscriberSpillTotalLimit(t *testing.T) {
+	conf := spillConfig(t, 1<<20, 15*(4+100))
+	var spillTotal atomic.Int64
+	first, second := testSubscriber(&spillTotal), testSubscriber(&spillTotal)
+	defer first.release()
+	for i := 0; i < maxQueuedFrames+10; i++ {
+		if !first.send(conf, testFrame(i, 100)) {
+			t.Fatalf("send() of frame %v failed", i)
+		}
+	}
+	for i := 0; i < maxQueuedFrames+5; i++ {
+		if !second.send(conf, testFrame(i, 100)) {
+			t.Fatalf("send() of frame %v failed", i)
+		}
+	}
+	if second.send(conf, testFrame(0, 100)) {
+		t.Fatal("send() past MaxSpillTotal should have failed")
+	}
+	second.release()
+	if total := spillTotal.Load(); total != 10*(4+100) {
+		t.Fatalf("spill total = %v, want what the remaining puller spilled", total)
+	}
+	if !first.send(conf, testFrame(0, 100)) {
+		t.Fatal("the space released by the dropped puller wasn't reused")
+	}
+}
+
+func TestSubscriberDrop(t *testing.T) {
+	conf := Config{SlowPullerPolicy: SlowPullerDrop}
+	sub := testSubscriber(new(atomic.Int64))
+	defer sub.release()
+	for i := 0; i < maxQueuedFrames; i++ {
+		if !sub.send(conf, testFrame(i, 10)) {
+			t.Fatalf("send() of frame %v failed", i)
+		}
+	}
+
+	// A puller that makes room in time is kept
+	sent := make(chan bool, 1)
+	go func() { sent <- sub.send(conf, testFrame(0, 10)) }()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := sub.next(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !<-sent {
+		t.Fatal("send() failed although the puller made room")
+	}
+
+	// A puller that doesn't is dropped once slowPullerTimeout has elapsed
+	start := time.Now()
+	if sub.send(conf, testFrame(0, 10)) {
+		t.Fatal("send() to a puller that doesn't receive anything should have failed")
+	}
+	if elapsed := time.Since(start); elapsed < slowPullerTimeout {
+		t.Fatalf("the puller was dropped after %v", elapsed)
+	}
+	if _, err := sub.next(nil); err != errPullerDropped {
+		t.Fatalf("next() = %v, want %v", err, errPullerDropped)
+	}
+}
@@ -0,0 +1,565 @@
+// Package server - Piknik server, relaying clipboard content, streams and
+// tunnels between clients.
+//
+// The server never sees the plaintext: content is encrypted and signed by the
+// clients, and the server only checks signatures. The clipboard content is
+// kept in a Store, and everything else in memory, so that several servers can
+// run in the same process, each with its own clipboard and channels.
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"github.com/jedisct1/piknik/internal/ratelimit"
+)
+
+const (
+	DefaultMaxClients      = 10
+	DefaultMaxWatchers     = 100
+	DefaultMaxWaitPullers  = 100
+	DefaultMaxReplayBytes  = uint64(64 * 1024 * 1024)
+	DefaultMaxReplayMemory = uint64(512 * 1024 * 1024)
+	DefaultSpoolRetention  = 24 * time.Hour
+	DefaultMaxSpoolBytes   = uint64(10 * 1024 * 1024 * 1024)
+	DefaultMaxSpillBytes   = uint64(1024 * 1024 * 1024)
+	DefaultMaxSpillTotal   = uint64(10 * 1024 * 1024 * 1024)
+
+	shutdownPollInterval = 500 * time.Millisecond
+)
+
+// ErrServerClosed - Returned by Serve after Shutdown has been called
+var ErrServerClosed = errors.New("Server closed")
+
+// Config - Keys and limits of a server
+type Config struct {
+	Psk               []byte
+	SignPk            []byte
+	MaxClients        uint64
+	TrustedIPCount    uint64
+	MaxLen            uint64
+	Timeout           time.Duration
+	DataTimeout       time.Duration
+	TTL               time.Duration
+	MaxStreamBytes    uint64
+	MaxStreamDuration time.Duration
+	MaxWaitingPullers uint
+	MaxReplayBytes    uint64
+	SpoolDir          string
+	SpoolRetention    time.Duration
+	MaxSpoolBytes     uint64
+	SlowPullerPolicy  string
+	MaxRate           uint64
+	MaxConnectionRate uint64
+
+	// MaxWatchers - Maximum number of clients watching the clipboard.
+	// Watchers stay connected indefinitely, so they don't count against
+	// MaxClients once their request has been authenticated.
+	MaxWatchers uint64
+
+	// MaxReplayMemory - Maximum size of the frames kept for replay, for all
+	// streams. Pushes asking for replay are rejected unless MaxReplayBytes
+	// more can be kept.
+	MaxReplayMemory uint64
+
+	// MaxSpillBytes, MaxSpillTotal - Maximum size of the spill file of a
+	// puller, and of all spill files, with the "spill" policy. Pullers are
+	// disconnected when they would be exceeded.
+	MaxSpillBytes uint64
+	MaxSpillTotal uint64
+
+	// Store - Where the clipboard content is kept. Content is kept in memory
+	// if nil.
+	Store Store
+
+	// ErrorLog - Where to log rejected requests and failed operations. The
+	// standard logger is used if nil.
+	ErrorLog *log.Logger
+}
+
+// Server - A Piknik server. Its clipboard and channels are not shared with
+// other servers.
+type Server struct {
+	conf         Config
+	clipboard    clipboard
+	streams      streamHub
+	tunnels      tunnelHub
+	uploads      pendingUploads
+	spool        streamSpool
+	trusted      trustedClients
+	clients      connectedClients
+	clientsCount atomic.Uint64
+	watchers     atomic.Uint64
+	spillTotal   atomic.Int64
+	bandwidth    *ratelimit.Bucket
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+	done      chan struct{}
+}
+
+type connection struct {
+	srv           *Server
+	conf          Config
+	conn          net.Conn
+	reader        *bufio.Reader
+	writer        *bufio.Writer
+	clientVersion byte
+}
+
+// New - Creates a server. Timeouts and limits that are not set use the same
+// defaults as the command-line server. Unlike the command-line server, there
+// is no limit on the size and duration of streams unless they are set.
+func New(conf Config) (*Server, error) {
+	if len(conf.Psk) != 32 || len(conf.SignPk) != 32 {
+		return nil, errors.New("The Psk and SignPk keys must be 32 bytes long")
+	}
+	if conf.MaxClients == 0 {
+		conf.MaxClients = DefaultMaxClients
+	}
+	if conf.MaxWatchers == 0 {
+		conf.MaxWatchers = DefaultMaxWatchers
+	}
+	if conf.TrustedIPCount == 0 {
+		conf.TrustedIPCount = max(1, conf.MaxClients/10)
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 10 * time.Second
+	}
+	if conf.DataTimeout <= 0 {
+		conf.DataTimeout = time.Hour
+	}
+	if conf.TTL <= 0 {
+		conf.TTL = 7 * 24 * time.Hour
+	}
+	if conf.MaxWaitingPullers == 0 {
+		conf.MaxWaitingPullers = DefaultMaxWaitPullers
+	}
+	if conf.MaxReplayBytes == 0 {
+		conf.MaxReplayBytes = DefaultMaxReplayBytes
+	}
+	if conf.MaxReplayMemory == 0 {
+		conf.MaxReplayMemory = max(DefaultMaxReplayMemory, conf.MaxReplayBytes)
+	}
+	if conf.MaxReplayMemory < conf.MaxReplayBytes {
+		return nil, errors.New("MaxReplayMemory can't be lower than MaxReplayBytes")
+	}
+	if conf.SpoolRetention <= 0 {
+		conf.SpoolRetention = DefaultSpoolRetention
+	}
+	if conf.MaxSpoolBytes == 0 {
+		conf.MaxSpoolBytes = DefaultMaxSpoolBytes
+	}
+	if conf.MaxSpillBytes == 0 {
+		conf.MaxSpillBytes = DefaultMaxSpillBytes
+	}
+	if conf.MaxSpillTotal == 0 {
+		conf.MaxSpillTotal = DefaultMaxSpillTotal
+	}
+	if conf.SlowPullerPolicy == "" {
+		conf.SlowPullerPolicy = SlowPullerBlock
+	}
+	if !ValidSlowPullerPolicy(conf.SlowPullerPolicy) {
+		return nil, fmt.Errorf("Unsupported slow puller policy [%v]", conf.SlowPullerPolicy)
+	}
+	if conf.Store == nil {
+		conf.Store = NewMemoryStore()
+	}
+	srv := &Server{
+		conf:      conf,
+		bandwidth: ratelimit.NewBucket(conf.MaxRate),
+		listeners: make(map[net.Listener]struct{}),
+		done:      make(chan struct{}),
+	}
+	srv.clipboard.store = conf.Store
+	srv.clipboard.changedCh = make(chan struct{})
+	srv.streams.channels = make(map[string]*streamChannel)
+	srv.tunnels.waiting = make(map[string][]*tunnelEnd)
+	srv.uploads.uploads = make(map[string]*pendingUpload)
+	srv.clients.clients = make(map[uint64]*connectedClient)
+	if conf.SpoolDir != "" {
+		if err := srv.spool.setup(conf); err != nil {
+			return nil, err
+		}
+		go srv.cleanupSpool()
+	}
+	return srv, nil
+}
+
+func (srv *Server) logger() *log.Logger {
+	if srv.conf.ErrorLog != nil {
+		return srv.conf.ErrorLog
+	}
+	return log.Default()
+}
+
+func (srv *Server) log(args ...any) {
+	srv.logger().Print(args...)
+}
+
+func (srv *Server) logf(format string, args ...any) {
+	srv.logger().Printf(format, args...)
+}
+
+// cleanupSpool - Periodically removes expired streams, until the server is
+// shut down
+func (srv *Server) cleanupSpool() {
+	ticker := time.NewTicker(spoolCleanupPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := srv.spool.cleanup(); err != nil {
+				srv.log(err)
+			}
+		case <-srv.done:
+			return
+		}
+	}
+}
+
+// Serve - Accepts connections on the listener, and serves them. The listener
+// is closed when Serve returns. Returns ErrServerClosed once Shutdown has been
+// called.
+func (srv *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listeners[listener] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, listener)
+		srv.mu.Unlock()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		srv.maybeAcceptClient(conn)
+	}
+}
+
+// Listening - Whether the server is accepting connections
+func (srv *Server) Listening() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.listeners) > 0
+}
+
+// Shutdown - Stops accepting connections, and waits for the connected clients
+// to leave. If ctx is canceled first, their connections are closed, and the
+// context error is returned. A server can't be restarted once shut down.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.done)
+	}
+	for listener := range srv.listeners {
+		listener.Close()
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for srv.clientsCount.Load()+srv.watchers.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			srv.clients.closeAll()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (srv *Server) handleClientConnection(conn net.Conn, id uint64) {
+	conf := srv.conf
+	defer conn.Close()
+	limitedReader, limitedWriter := ratelimit.Limit(conn, srv.bandwidth, ratelimit.NewBucket(conf.MaxConnectionRate))
+	reader, writer := bufio.NewReader(limitedReader), bufio.NewWriter(limitedWriter)
+	cnx := connection{
+		srv:    srv,
+		conf:   conf,
+		conn:   conn,
+		reader: reader,
+		writer: writer,
+	}
+	rbuf := make([]byte, 65)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		return
+	}
+	cnx.clientVersion = rbuf[0]
+	if cnx.clientVersion < 6 || cnx.clientVersion > protocol.Version {
+		srv.log("Unsupported client version - Please run the same version on the server and on the client")
+		return
+	}
+	r := rbuf[1:33]
+	h0 := rbuf[33:65]
+	wh0 := protocol.Auth0(conf.Psk, cnx.clientVersion, r)
+	if subtle.ConstantTimeCompare(wh0, h0) != 1 {
+		return
+	}
+	r2 := make([]byte, 32)
+	rand.Read(r2)
+	h1 := protocol.Auth1(conf.Psk, cnx.clientVersion, h0, r2)
+	writer.Write([]byte{cnx.clientVersion})
+	writer.Write(r2)
+	writer.Write(h1)
+	if err := writer.Flush(); err != nil {
+		srv.log(err)
+		return
+	}
+	srv.trusted.add(conf, clientIP(conn))
+	opcode, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	srv.clients.update(id, cnx.clientVersion, opcode)
+	switch opcode {
+	case byte('G'):
+		cnx.getOperation(h1, false)
+	case byte('M'):
+		cnx.getOperation(h1, true)
+	case byte('S'):
+		cnx.storeOperation(h1)
+	case byte('U'):
+		if cnx.clientVersion < 8 {
+			srv.log("Resumable uploads require protocol version 8")
+			return
+		}
+		cnx.uploadOperation(h1)
+	case byte('T'):
+		if cnx.clientVersion < 8 {
+			srv.log("Tunnels require protocol version 8")
+			return
+		}
+		cnx.tunnelOperation(h1)
+	case byte('N'):
+		if cnx.clientVersion < 7 {
+			srv.log("Waiting for clipboard content requires protocol version 7")
+			return
+		}
+		cnx.waitGetOperation(h1)
+	case byte('I'):
+		if cnx.clientVersion < 7 {
+			srv.log("Clipboard status requires protocol version 7")
+			return
+		}
+		cnx.infoOperation(h1)
+	case byte('D'):
+		if cnx.clientVersion < 7 {
+			srv.log("Clearing the clipboard requires protocol version 7")
+			return
+		}
+		cnx.clearOperation(h1)
+	case byte('W'):
+		if cnx.clientVersion < 7 {
+			srv.log("Watching the clipboard requires protocol version 7")
+			return
+		}
+		cnx.watchOperation(h1)
+	case byte('P'):
+		if cnx.clientVersion < 7 {
+			srv.log("Stream push requires protocol version 7")
+			return
+		}
+		cnx.pushStreamOperation(h1)
+	case byte('L'):
+		if cnx.clientVersion < 7 {
+			srv.log("Stream pull requires protocol version 7")
+			return
+		}
+		cnx.pullStreamOperation(h1)
+	}
+}
+
+// clientIP - IP address of a client, or nil if it isn't connected over TCP
+func clientIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// trustedClients - Addresses of the clients that recently completed the
+// handshake. They can still connect when the server is almost full.
+type trustedClients struct {
+	sync.RWMutex
+
+	ips []net.IP
+}
+
+func (trusted *trustedClients) add(conf Config, ip net.IP) {
+	if ip == nil {
+		return
+	}
+	trusted.Lock()
+	if uint64(len(trusted.ips)) >= conf.TrustedIPCount {
+		trusted.ips = append(trusted.ips[1:], ip)
+	} else {
+		trusted.ips = append(trusted.ips, ip)
+	}
+	trusted.Unlock()
+}
+
+func (trusted *trustedClients) contains(ip net.IP) bool {
+	trusted.RLock()
+	defer trusted.RUnlock()
+	if len(trusted.ips) == 0 || ip == nil {
+		return true
+	}
+	for _, foundIP := range trusted.ips {
+		if foundIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientInfo - A connected client. Version and Opcode are 0 until the client
+// has sent them.
+type ClientInfo struct {
+	ID         uint64
+	RemoteAddr net.Addr
+	Since      time.Time
+	Version    byte
+	Opcode     byte
+}
+
+type connectedClient struct {
+	conn    net.Conn
+	since   time.Time
+	version byte
+	opcode  byte
+}
+
+type connectedClients struct {
+	sync.Mutex
+
+	clients map[uint64]*connectedClient
+	nextID  uint64
+}
+
+func (clients *connectedClients) add(conn net.Conn) uint64 {
+	clients.Lock()
+	defer clients.Unlock()
+	id := clients.nextID
+	clients.nextID++
+	clients.clients[id] = &connectedClient{conn: conn, since: time.Now()}
+	return id
+}
+
+func (clients *connectedClients) update(id uint64, version byte, opcode byte) {
+	clients.Lock()
+	if client, ok := clients.clients[id]; ok {
+		client.version, client.opcode = version, opcode
+	}
+	clients.Unlock()
+}
+
+func (clients *connectedClients) remove(id uint64) {
+	clients.Lock()
+	delete(clients.clients, id)
+	clients.Unlock()
+}
+
+func (clients *connectedClients) closeAll() {
+	clients.Lock()
+	for _, client := range clients.clients {
+		client.conn.Close()
+	}
+	clients.Unlock()
+}
+
+// Clients - Returns the connected clients, by ID
+func (srv *Server) Clients() []ClientInfo {
+	srv.clients.Lock()
+	defer srv.clients.Unlock()
+	infos := make([]ClientInfo, 0, len(srv.clients.clients))
+	for id, client := range srv.clients.clients {
+		infos = append(infos, ClientInfo{
+			ID:         id,
+			RemoteAddr: client.conn.RemoteAddr(),
+			Since:      client.since,
+			Version:    client.version,
+			Opcode:     client.opcode,
+		})
+	}
+	slices.SortFunc(infos, func(a, b ClientInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return infos
+}
+
+// startWatching - Moves a client from the client slots to the watcher slots.
+// Returns false if all the watcher slots are in use.
+func (srv *Server) startWatching() bool {
+	for {
+		count := srv.watchers.Load()
+		if count >= srv.conf.MaxWatchers {
+			return false
+		} else if srv.watchers.CompareAndSwap(count, count+1) {
+			break
+		}
+	}
+	srv.clientsCount.Add(^uint64(0))
+	return true
+}
+
+// stopWatching - Moves a watcher back to the client slots, so that it is
+// released along with any other client
+func (srv *Server) stopWatching() {
+	srv.clientsCount.Add(1)
+	srv.watchers.Add(^uint64(0))
+}
+
+func (srv *Server) acceptClient(conn net.Conn, id uint64) {
+	srv.handleClientConnection(conn, id)
+	srv.clients.remove(id)
+	srv.clientsCount.Add(^uint64(0))
+}
+
+func (srv *Server) maybeAcceptClient(conn net.Conn) {
+	conf := srv.conf
+	conn.SetDeadline(time.Now().Add(conf.Timeout))
+	remoteIP := clientIP(conn)
+	for {
+		count := srv.clientsCount.Load()
+		if count >= conf.MaxClients-conf.TrustedIPCount && !srv.trusted.contains(remoteIP) {
+			conn.Close()
+			return
+		}
+		if count >= conf.MaxClients {
+			conn.Close()
+			return
+		} else if srv.clientsCount.CompareAndSwap(count, count+1) {
+			break
+		}
+	}
+	id := srv.clients.add(conn)
+	go srv.acceptClient(conn, id)
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+	"github.com/jedisct1/piknik/internal/testutil"
+)
+
+// testConfigs - Matching server and client configurations, with random keys
+func testConfigs(t *testing.T) (Config, client.Config) {
+	t.Helper()
+	clientConf := testutil.ClientConfig(t)
+	serverConf := Config{
+		Psk:      clientConf.Psk,
+		SignPk:   clientConf.SignPk,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	return serverConf, clientConf
+}
+
+// startTestServer - Serves on a local port until the test ends, and returns
+// the server and its address
+func startTestServer(t *testing.T, conf Config) (*Server, string) {
+	t.Helper()
+	srv, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, testutil.Start(t, srv)
+}
+
+func TestShutdown(t *testing.T) {
+	serverConf, clientConf := testConfigs(t)
+	srv, err := New(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, served := testutil.Serve(t, srv)
+	clientConf.Connect = addr
+	if err := testutil.NewClient(t, clientConf).Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.Listening() {
+		t.Fatal("Listening() = false while serving")
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve() = %v, want %v", err, ErrServerClosed)
+	}
+	if srv.Listening() {
+		t.Fatal("Listening() = true after Shutdown()")
+	}
+	if err := testutil.NewClient(t, clientConf).Ping(context.Background()); err == nil {
+		t.Fatal("the server still accepts connections after Shutdown()")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(listener); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve() after Shutdown() = %v, want %v", err, ErrServerClosed)
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Fatal("Serve() didn't close the listener")
+	}
+}
+
+func TestShutdownWaitsForClients(t *testing.T) {
+	serverConf, clientConf := testConfigs(t)
+	srv, err := New(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConf.Connect, _ = testutil.Serve(t, srv)
+	c := testutil.NewClient(t, clientConf)
+	pasted := make(chan error, 1)
+	go func() {
+		pasted <- c.Paste(context.Background(), io.Discard, &client.PasteOptions{Wait: time.Second})
+	}()
+	waitForClients(t, srv, 1)
+
+	start := time.Now()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("Shutdown() returned after %v, before the client left", elapsed)
+	}
+	if err := <-pasted; !errors.Is(err, client.ErrEmpty) {
+		t.Fatalf("Paste() = %v, want %v", err, client.ErrEmpty)
+	}
+}
+
+func TestShutdownClosesClients(t *testing.T) {
+	serverConf, clientConf := testConfigs(t)
+	srv, err := New(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConf.Connect, _ = testutil.Serve(t, srv)
+	c := testutil.NewClient(t, clientConf)
+	pasted, watched := make(chan error, 1), make(chan error, 1)
+	go func() {
+		pasted <- c.Paste(context.Background(), io.Discard, &client.PasteOptions{Wait: time.Hour})
+	}()
+	go func() {
+		watched <- c.Watch(context.Background(), func(item *client.Item) error { return nil })
+	}()
+	waitForClients(t, srv, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	for _, done := range []chan error{pasted, watched} {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("a client whose connection was closed didn't fail")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the connection of a client wasn't closed")
+		}
+	}
+}
+
+// waitForClients - Waits until count clients have sent their request
+func waitForClients(t *testing.T, srv *Server, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		waiting := 0
+		for _, info := range srv.Clients() {
+			if info.Opcode != 0 {
+				waiting++
+			}
+		}
+		if waiting >= count {
+			// Leave the server a moment to read the rest of the requests
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %v of %v clients connected", waiting, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	ctx := context.Background()
+	serverConf, clientConf := testConfigs(t)
+	srvA, addrA := startTestServer(t, serverConf)
+	srvB, addrB := startTestServer(t, serverConf)
+	clientConf.Connect = addrA
+	clientA := testutil.NewClient(t, clientConf)
+	clientConf.Connect = addrB
+	clientB := testutil.NewClient(t, clientConf)
+
+	if err := clientA.Copy(ctx, bytes.NewReader([]byte("A")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientB.Paste(ctx, io.Discard, nil); !errors.Is(err, client.ErrEmpty) {
+		t.Fatalf("Paste() from the other server = %v, want %v", err, client.ErrEmpty)
+	}
+	if err := clientB.Copy(ctx, bytes.NewReader([]byte("B")), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		c    *client.Client
+		want string
+	}{{clientA, "A"}, {clientB, "B"}} {
+		var pasted bytes.Buffer
+		if err := test.c.Paste(ctx, &pasted, nil); err != nil || pasted.String() != test.want {
+			t.Fatalf("Paste() = %q, %v, want %q", pasted.String(), err, test.want)
+		}
+	}
+
+	if cleared, err := srvA.Clear(); !cleared || err != nil {
+		t.Fatalf("Clear() = %v, %v", cleared, err)
+	}
+	if content, err := srvB.Clipboard(); content == nil || err != nil {
+		t.Fatalf("clearing a server cleared the other one (%v)", err)
+	}
+}
+
+func TestMemoryStoreZeroes(t *testing.T) {
+	store := NewMemoryStore()
+	ciphertext := bytes.Repeat([]byte{3}, 100)
+	store.Save(&Content{Ciphertext: ciphertext})
+	loaded, err := store.Load()
+	if err != nil || !bytes.Equal(loaded.Ciphertext, ciphertext) {
+		t.Fatalf("Load() = %+v, %v", loaded, err)
+	}
+
+	// Replacing the content zeroes the previous ciphertext
+	replacement := bytes.Repeat([]byte{4}, 100)
+	store.Save(&Content{Ciphertext: replacement})
+	if !bytes.Equal(ciphertext, make([]byte, 100)) {
+		t.Fatal("the replaced ciphertext wasn't zeroed")
+	}
+	// So does deleting it, without altering what was loaded before
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replacement, make([]byte, 100)) {
+		t.Fatal("the deleted ciphertext wasn't zeroed")
+	}
+	if !bytes.Equal(loaded.Ciphertext, bytes.Repeat([]byte{3}, 100)) {
+		t.Fatal("zeroing the ciphertext altered a loaded copy")
+	}
+	if content, err := store.Load(); content != nil || err != nil {
+		t.Fatalf("Load() = %v, %v after Delete()", content, err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clipboard")
+	store := NewFileStore(path)
+	if content, err := store.Load(); content != nil || err != nil {
+		t.Fatalf("Load() = %v, %v for a missing file", content, err)
+	}
+
+	content := &Content{
+		Ts:         bytes.Repeat([]byte{1}, 8),
+		Signature:  bytes.Repeat([]byte{2}, 64),
+		Ciphertext: bytes.Repeat([]byte{3}, 8+24+100),
+		StoredAt:   time.Unix(1700000000, 123456789),
+	}
+	if err := store.Save(content); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewFileStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Ts, content.Ts) || !bytes.Equal(loaded.Signature, content.Signature) ||
+		!bytes.Equal(loaded.Ciphertext, content.Ciphertext) || !loaded.StoredAt.Equal(content.StoredAt) {
+		t.Fatalf("Load() = %+v, want %+v", loaded, content)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Save() left %v files behind (%v)", len(entries), err)
+	}
+
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := store.Load(); content != nil || err != nil {
+		t.Fatalf("Load() = %v, %v after Delete()", content, err)
+	}
+	if err := store.Delete(); err != nil {
+		t.Fatalf("Delete() of a missing file = %v", err)
+	}
+}
+
+func TestFileStoreTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clipboard")
+	if err := os.WriteFile(path, make([]byte, fileStoreHeaderLen+8+24-1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := NewFileStore(path).Load(); err == nil {
+		t.Fatalf("Load() = %+v for a truncated file, want an error", content)
+	}
+}
+
+func TestFileStoreSurvivesRestarts(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "clipboard")
+	serverConf, clientConf := testConfigs(t)
+	serverConf.Store = NewFileStore(path)
+	srv, err := New(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, served := testutil.Serve(t, srv)
+	clientConf.Connect = addr
+	if err := testutil.NewClient(t, clientConf).Copy(ctx, bytes.NewReader([]byte("persistent")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-served
+
+	serverConf.Store = NewFileStore(path)
+	_, clientConf.Connect = startTestServer(t, serverConf)
+	var pasted bytes.Buffer
+	if err := testutil.NewClient(t, clientConf).Paste(ctx, &pasted, nil); err != nil || pasted.String() != "persistent" {
+		t.Fatalf("Paste() after a restart = %q, %v", pasted.String(), err)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+)
+
+// Stored streams are spooled to disk as they are relayed: the header, the
+// sealed frames and the end frame, exactly as pullers receive them. The file
+// only gets its final name once the end frame has been written, so that
+// pullers never receive a partial stream. There is at most one stored stream
+// per channel; a new one replaces the previous one.
+
+const (
+	spoolSuffix        = ".stream"
+	spoolTmpSuffix     = ".tmp"
+	spoolCleanupPeriod = time.Minute
+)
+
+var errSpoolFull = errors.New("Stream spool is full")
+
+// streamSpool - Directory where stored streams are kept
+type streamSpool struct {
+	sync.Mutex
+
+	dir       string
+	retention time.Duration
+	maxBytes  uint64
+	usage     uint64
+}
+
+// spoolWriter - A stream being spooled
+type spoolWriter struct {
+	spool     *streamSpool
+	file      *os.File
+	path      string
+	reserved  uint64
+	committed bool
+}
+
+// setup - Creates the spool directory if needed, and removes the streams that
+// were still being stored when the server stopped
+func (spool *streamSpool) setup(conf Config) error {
+	spool.dir = conf.SpoolDir
+	spool.retention = conf.SpoolRetention
+	spool.maxBytes = conf.MaxSpoolBytes
+	if err := os.MkdirAll(conf.SpoolDir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(conf.SpoolDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), spoolTmpSuffix) {
+			os.Remove(filepath.Join(conf.SpoolDir, entry.Name()))
+		}
+	}
+	return spool.cleanup()
+}
+
+func (spool *streamSpool) enabled() bool {
+	return spool.dir != ""
+}
+
+func (spool *streamSpool) path(channelID []byte) string {
+	return filepath.Join(spool.dir, hex.EncodeToString(channelID)+spoolSuffix)
+}
+
+// cleanup - Removes expired streams, and recomputes the disk usage
+func (spool *streamSpool) cleanup() error {
+	spool.Lock()
+	defer spool.Unlock()
+	entries, err := os.ReadDir(spool.dir)
+	if err != nil {
+		return err
+	}
+	usage := uint64(0)
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), spoolSuffix) && time.Since(fi.ModTime()) >= spool.retention {
+			os.Remove(filepath.Join(spool.dir, entry.Name()))
+			continue
+		}
+		usage += uint64(fi.Size())
+	}
+	spool.usage = usage
+	return nil
+}
+
+// open - Opens the stored stream of a channel, or returns nil if there is
+// none or if it has expired
+func (spool *streamSpool) open(channelID []byte) *os.File {
+	if !spool.enabled() {
+		return nil
+	}
+	file, err := os.Open(spool.path(channelID))
+	if err != nil {
+		return nil
+	}
+	if fi, err := file.Stat(); err != nil || time.Since(fi.ModTime()) >= spool.retention {
+		file.Close()
+		return nil
+	}
+	return file
+}
+
+func (spool *streamSpool) create(channelID []byte) (*spoolWriter, error) {
+	file, err := os.CreateTemp(spool.dir, hex.EncodeToString(channelID)+".*"+spoolTmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &spoolWriter{spool: spool, file: file, path: spool.path(channelID)}, nil
+}
+
+func (w *spoolWriter) Write(frame []byte) (int, error) {
+	spool := w.spool
+	spool.Lock()
+	if spool.usage+uint64(len(frame)) > spool.maxBytes {
+		spool.Unlock()
+		return 0, errSpoolFull
+	}
+	spool.usage += uint64(len(frame))
+	spool.Unlock()
+	w.reserved += uint64(len(frame))
+	return w.file.Write(frame)
+}
+
+// commit - Makes the complete stream available to pullers, replacing the
+// previous stream of the same channel
+func (w *spoolWriter) commit() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	spool := w.spool
+	spool.Lock()
+	defer spool.Unlock()
+	if fi, err := os.Stat(w.path); err == nil {
+		spool.usage -= min(spool.usage, uint64(fi.Size()))
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+// discard - Removes an incomplete stream
+func (w *spoolWriter) discard() {
+	if w.committed {
+		return
+	}
+	w.file.Close()
+	os.Remove(w.file.Name())
+	spool := w.spool
+	spool.Lock()
+	spool.usage -= min(spool.usage, w.reserved)
+	spool.Unlock()
+}
+
+// serveStoredStream - Sends a stored stream to a puller. Its pusher is gone,
+// so the puller isn't asked to acknowledge it.
+func (cnx *connection) serveStoredStream(file *os.File) error {
+	conf, writer := cnx.conf, cnx.writer
+	buf := make([]byte, 4+protocol.MaxChunk+16)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+			if _, err := writer.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+			writer.WriteByte(0x00)
+			return writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// resumeStoredStream - Sends the rest of a stored stream to a puller resuming
+// it, or rejects the request if that stream isn't stored
+func (cnx *connection) resumeStoredStream(file *os.File, resume *protocol.StreamResume, channelName string) {
+	writer := cnx.writer
+	header, err := []byte(nil), errors.New("no stored stream")
+	if file != nil {
+		header, err = seekStoredStream(file, resume)
+	}
+	if err != nil {
+		cnx.srv.logf("Stream pull rejected: unable to resume the stream on channel %v: %v", channelName, err)
+		writer.WriteByte(0x04)
+		writer.Flush()
+		return
+	}
+	writer.WriteByte(0x01)
+	writer.Write(header)
+	if err := cnx.serveStoredStream(file); err != nil {
+		cnx.srv.logf("Stored stream on channel %v: %v", channelName, err)
+	}
+}
+
+// seekStoredStream - Reads the header of a stored stream, and skips the chunks
+// that a puller resuming it has already received
+func seekStoredStream(file *os.File, resume *protocol.StreamResume) ([]byte, error) {
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[16:32], resume.NoncePrefix) {
+		return nil, errors.New("a different stream is stored")
+	}
+	lenBuf := make([]byte, 4)
+	for i := uint64(0); i < resume.ChunkIndex; i++ {
+		if _, err := io.ReadFull(file, lenBuf); err != nil {
+			return nil, err
+		}
+		chunkLen := binary.LittleEndian.Uint32(lenBuf)
+		if chunkLen == 0 {
+			return nil, errors.New("position past the end of the stream")
+		}
+		if _, err := file.Seek(int64(chunkLen)+16, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+)
+
+func testSpool(t *testing.T, maxBytes uint64) *streamSpool {
+	t.Helper()
+	spool := &streamSpool{}
+	if err := spool.setup(Config{SpoolDir: t.TempDir(), SpoolRetention: time.Hour, MaxSpoolBytes: maxBytes}); err != nil {
+		t.Fatal(err)
+	}
+	return spool
+}
+
+// storedStream - A stream as it is spooled: the header, data frames holding
+// the given chunk lengths, and the end frame
+func storedStream(noncePrefix []byte, chunkLens ...int) []byte {
+	stream := make([]byte, 16, 32)
+	stream = append(stream, noncePrefix...)
+	for i, chunkLen := range chunkLens {
+		stream = binary.LittleEndian.AppendUint32(stream, uint32(chunkLen))
+		stream = append(stream, bytes.Repeat([]byte{byte(i)}, chunkLen+16)...)
+	}
+	stream = binary.LittleEndian.AppendUint32(stream, 0)
+	return append(stream, make([]byte, 64)...)
+}
+
+func TestSpoolCommit(t *testing.T) {
+	spool := testSpool(t, 1<<20)
+	channelID := bytes.Repeat([]byte{1}, protocol.ChannelIDLen)
+	if spool.open(channelID) != nil {
+		t.Fatal("open() returned a stream that was never stored")
+	}
+	stream := storedStream(bytes.Repeat([]byte{9}, 16), 10, 20)
+
+	w, err := spool.create(channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if spool.open(channelID) != nil {
+		t.Fatal("open() returned a stream that wasn't committed yet")
+	}
+	if err := w.commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.discard()
+
+	file := spool.open(channelID)
+	if file == nil {
+		t.Fatal("open() didn't return the committed stream")
+	}
+	defer file.Close()
+	stored, err := io.ReadAll(file)
+	if err != nil || !bytes.Equal(stored, stream) {
+		t.Fatalf("stored stream differs (%v)", err)
+	}
+	if spool.usage != uint64(len(stream)) {
+		t.Fatalf("usage = %v, want %v", spool.usage, len(stream))
+	}
+
+	// A new stream replaces the previous one, whose space is released
+	w, err = spool.create(channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(stream[:100])
+	if err := w.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if spool.usage != 100 {
+		t.Fatalf("usage = %v after replacing the stream, want 100", spool.usage)
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	spool := testSpool(t, 100)
+	w, err := spool.create(bytes.Repeat([]byte{2}, protocol.ChannelIDLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 60)); err != errSpoolFull {
+		t.Fatalf("Write() = %v, want %v", err, errSpoolFull)
+	}
+	w.discard()
+	if spool.usage != 0 {
+		t.Fatalf("usage = %v after discarding the stream, want 0", spool.usage)
+	}
+	if _, err := os.Stat(w.file.Name()); !os.IsNotExist(err) {
+		t.Fatal("discard() didn't remove the temporary file")
+	}
+}
+
+func TestSpoolSetupCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "00.1234"+spoolTmpSuffix)
+	expired := filepath.Join(dir, "01"+spoolSuffix)
+	kept := filepath.Join(dir, "02"+spoolSuffix)
+	for _, path := range []string{tmp, expired, kept} {
+		if err := os.WriteFile(path, make([]byte, 10), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(expired, old, old)
+
+	spool := &streamSpool{}
+	if err := spool.setup(Config{SpoolDir: dir, SpoolRetention: time.Hour, MaxSpoolBytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{tmp, expired} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("[%v] should have been removed", path)
+		}
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatal(err)
+	}
+	if spool.usage != 10 {
+		t.Fatalf("usage = %v, want 10", spool.usage)
+	}
+}
+
+func TestSeekStoredStream(t *testing.T) {
+	noncePrefix := bytes.Repeat([]byte{9}, 16)
+	chunkLens := []int{10, 20, 30}
+	stream := storedStream(noncePrefix, chunkLens...)
+	path := filepath.Join(t.TempDir(), "stream")
+	if err := os.WriteFile(path, stream, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	offset := 32
+	for chunkIndex := 0; chunkIndex <= len(chunkLens); chunkIndex++ {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := seekStoredStream(file, &protocol.StreamResume{NoncePrefix: noncePrefix, ChunkIndex: uint64(chunkIndex)})
+		if err != nil {
+			t.Fatalf("chunk %v: %v", chunkIndex, err)
+		}
+		if !bytes.Equal(header, stream[:32]) {
+			t.Fatalf("chunk %v: header = %x", chunkIndex, header)
+		}
+		rest, _ := io.ReadAll(file)
+		file.Close()
+		if !bytes.Equal(rest, stream[offset:]) {
+			t.Fatalf("chunk %v: resumed at the wrong position", chunkIndex)
+		}
+		if chunkIndex < len(chunkLens) {
+			offset += 4 + chunkLens[chunkIndex] + 16
+		}
+	}
+
+	tests := []struct {
+		name   string
+		resume protocol.StreamResume
+	}{
+		{"past the end", protocol.StreamResume{NoncePrefix: noncePrefix, ChunkIndex: uint64(len(chunkLens)) + 1}},
+		{"different stream", protocol.StreamResume{NoncePrefix: bytes.Repeat([]byte{8}, 16)}},
+	}
+	for _, test := range tests {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := seekStoredStream(file, &test.resume); err == nil {
+			t.Errorf("%v: seekStoredStream() should have failed", test.name)
+		}
+		file.Close()
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Content - Clipboard content, as copied by a client. It is encrypted and
+// signed by the client, so a store never sees the plaintext.
+type Content struct {
+	// Ts - Timestamp set by the client, 8 bytes
+	Ts []byte
+	// Signature - Signature of the ciphertext, 64 bytes
+	Signature []byte
+	// Ciphertext - Encryption key ID, nonce and encrypted content
+	Ciphertext []byte
+	// StoredAt - When the server received the content
+	StoredAt time.Time
+}
+
+// Store - Where a server keeps the clipboard content. A store must not be
+// shared by several servers. Calls are serialized by the server, and the
+// content returned by Load must not be modified afterwards.
+type Store interface {
+	// Load - Returns the content, or nil if the clipboard is empty
+	Load() (*Content, error)
+	// Save - Replaces the content
+	Save(content *Content) error
+	// Delete - Removes the content
+	Delete() error
+}
+
+// MemoryStore - Keeps the content in memory. This is the default store.
+// Load returns a copy of the content, so that the ciphertext can be zeroed
+// once it is replaced or deleted, even while a copy is being sent.
+type MemoryStore struct {
+	mu      sync.Mutex
+	content *Content
+}
+
+// NewMemoryStore - Creates an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (store *MemoryStore) Load() (*Content, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.content == nil {
+		return nil, nil
+	}
+	content := *store.content
+	content.Ciphertext = bytes.Clone(content.Ciphertext)
+	return &content, nil
+}
+
+func (store *MemoryStore) Save(content *Content) error {
+	store.mu.Lock()
+	store.replace(content)
+	store.mu.Unlock()
+	return nil
+}
+
+func (store *MemoryStore) Delete() error {
+	store.mu.Lock()
+	store.replace(nil)
+	store.mu.Unlock()
+	return nil
+}
+
+// replace - Replaces the content, zeroing the previous ciphertext
+func (store *MemoryStore) replace(content *Content) {
+	if store.content != nil {
+		clear(store.content.Ciphertext)
+	}
+	store.content = content
+}
+
+// fileStoreHeaderLen - Timestamp, storage time and signature
+const fileStoreHeaderLen = 8 + 8 + 64
+
+// FileStore - Keeps the content in a file, so that it survives restarts. The
+// file is replaced atomically, and only contains what the server would keep
+// in memory: the encrypted content, its signature and timestamps.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore - Creates a store using the given file. Its directory must
+// exist.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (store *FileStore) Load() (*Content, error) {
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < fileStoreHeaderLen+8+24 {
+		return nil, fmt.Errorf("Clipboard file [%v] is truncated", store.path)
+	}
+	return &Content{
+		Ts:         data[0:8],
+		StoredAt:   time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:16]))),
+		Signature:  data[16:80],
+		Ciphertext: data[fileStoreHeaderLen:],
+	}, nil
+}
+
+func (store *FileStore) Save(content *Content) error {
+	file, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	header := make([]byte, 0, fileStoreHeaderLen)
+	header = append(header, content.Ts...)
+	header = binary.LittleEndian.AppendUint64(header, uint64(content.StoredAt.UnixNano()))
+	header = append(header, content.Signature...)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(content.Ciphertext); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), store.path)
+}
+
+func (store *FileStore) Delete() error {
+	if err := os.Remove(store.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,789 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+)
+
+// relayedStream - A stream being relayed to pullers. If it can be replayed,
+// its frames are also kept, so that pullers joining late can receive it from
+// the beginning. Pullers can join a live stream at any time, and receive it
+// from the current position; what they send is forwarded to the pusher.
+type relayedStream struct {
+	receivers  map[uint64]*subscriber
+	replay     bool
+	frames     [][]byte
+	size       uint64
+	overflowed bool
+	ended      bool
+	failed     bool
+	expiresAt  time.Time
+	live       bool
+	header     []byte
+	chunks     uint64
+	inputMu    sync.Mutex
+	input      *bufio.Writer
+}
+
+// replayable - Whether late pullers can still receive the whole stream. The
+// hub must be locked.
+func (stream *relayedStream) replayable() bool {
+	return stream.replay && !stream.overflowed && !stream.failed && time.Now().Before(stream.expiresAt)
+}
+
+// resumedFrames - Frames to send to a puller resuming the stream: the header,
+// followed by the frames it didn't receive yet. Returns nil if the stream
+// can't be resumed from that position. The hub must be locked.
+func (stream *relayedStream) resumedFrames(resume *protocol.StreamResume) [][]byte {
+	if !stream.replayable() || len(stream.frames) == 0 ||
+		!bytes.Equal(stream.frames[0][16:32], resume.NoncePrefix) ||
+		resume.ChunkIndex >= uint64(len(stream.frames)) {
+		return nil
+	}
+	frames := [][]byte{stream.frames[0]}
+	return append(frames, stream.frames[1+resume.ChunkIndex:]...)
+}
+
+// liveFrames - Frames to send to a puller joining a live stream: the header,
+// and the index of the next chunk. Returns nil if the stream can't be joined.
+// The hub must be locked.
+func (stream *relayedStream) liveFrames() [][]byte {
+	if !stream.live || stream.ended || stream.header == nil || stream.input == nil {
+		return nil
+	}
+	return [][]byte{stream.header, binary.LittleEndian.AppendUint64(nil, stream.chunks)}
+}
+
+// forward - Sends a frame to the pusher of a live stream. An empty frame tells
+// the pusher that a puller joined.
+func (stream *relayedStream) forward(frame []byte) error {
+	stream.inputMu.Lock()
+	defer stream.inputMu.Unlock()
+	binary.Write(stream.input, binary.LittleEndian, uint32(len(frame)))
+	stream.input.Write(frame)
+	return stream.input.Flush()
+}
+
+// streamChannel - Pushers and pullers sharing a channel identifier
+type streamChannel struct {
+	pushActive  bool
+	pushWaiting bool
+	pushConn    net.Conn
+	pullers     map[uint64]*subscriber
+	waitCh      chan struct{}
+	joinedCh    chan struct{}
+	stream      *relayedStream
+}
+
+// streamHub - Channels in use, and the size of the frames kept for replay
+type streamHub struct {
+	mu          sync.Mutex
+	channels    map[string]*streamChannel
+	nextID      uint64
+	replayBytes uint64
+}
+
+// keepForReplay - Keeps a frame for late pullers, unless the stream or the
+// hub would keep too much. Once that happens, the frames of the stream are
+// dropped. The hub must be locked.
+func (hub *streamHub) keepForReplay(conf Config, stream *relayedStream, frame []byte) bool {
+	frameLen := uint64(len(frame))
+	if stream.size+frameLen > conf.MaxReplayBytes || hub.replayBytes+frameLen > conf.MaxReplayMemory {
+		hub.dropReplay(stream)
+		stream.overflowed = true
+		return false
+	}
+	stream.frames = append(stream.frames, frame)
+	stream.size += frameLen
+	hub.replayBytes += frameLen
+	return true
+}
+
+// dropReplay - Drops the frames kept for replay. The hub must be locked.
+func (hub *streamHub) dropReplay(stream *relayedStream) {
+	hub.replayBytes -= stream.size
+	stream.frames, stream.size = nil, 0
+}
+
+// channel - Returns a channel, creating it if it doesn't exist yet. The hub
+// must be locked.
+func (hub *streamHub) channel(channelID []byte) *streamChannel {
+	channel, ok := hub.channels[string(channelID)]
+	if !ok {
+		channel = &streamChannel{
+			pullers:  make(map[uint64]*subscriber),
+			waitCh:   make(chan struct{}),
+			joinedCh: make(chan struct{}),
+		}
+		hub.channels[string(channelID)] = channel
+	}
+	return channel
+}
+
+// waitingPullers - Returns the pullers waiting for the next push. The hub must
+// be locked.
+func (channel *streamChannel) waitingPullers() map[uint64]*subscriber {
+	waiting := make(map[uint64]*subscriber)
+	for id, sub := range channel.pullers {
+		if sub.waiting {
+			waiting[id] = sub
+		}
+	}
+	return waiting
+}
+
+// release - Forgets a channel once it is unused. The hub must be locked.
+func (hub *streamHub) release(channelID []byte) {
+	channel, ok := hub.channels[string(channelID)]
+	if ok && !channel.pushActive && !channel.pushWaiting && channel.stream == nil && len(channel.pullers) == 0 {
+		delete(hub.channels, string(channelID))
+	}
+}
+
+// readStreamRequest - Reads and authenticates the opcode authentication code
+// and, since protocol version 8, the stream options. Version 7 clients all
+// share the same, all-zero channel.
+func (cnx *connection) readStreamRequest(h1 []byte, opcode byte) *protocol.StreamOptions {
+	conf, reader := cnx.conf, cnx.reader
+	h2 := make([]byte, 32)
+	if _, err := io.ReadFull(reader, h2); err != nil {
+		cnx.srv.log(err)
+		return nil
+	}
+	if cnx.clientVersion < 8 {
+		wh2 := protocol.Auth2Get(conf.Psk, cnx.clientVersion, h1, opcode)
+		if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+			return nil
+		}
+		return &protocol.StreamOptions{Channel: make([]byte, protocol.ChannelIDLen)}
+	}
+	encodedOpts, err := protocol.ReadStreamOptions(reader)
+	if err != nil {
+		cnx.srv.log(err)
+		return nil
+	}
+	wh2 := protocol.Auth2Stream(conf.Psk, cnx.clientVersion, h1, opcode, encodedOpts)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return nil
+	}
+	opts, err := protocol.DecodeStreamOptions(encodedOpts)
+	if err != nil {
+		cnx.srv.log(err)
+		return nil
+	}
+	return opts
+}
+
+func (cnx *connection) pullStreamOperation(h1 []byte) {
+	conf, writer := cnx.conf, cnx.writer
+	opts := cnx.readStreamRequest(h1, byte('L'))
+	if opts == nil {
+		return
+	}
+	channelName := protocol.ChannelLabel(opts.Channel)
+	hub := &cnx.srv.streams
+	stored := cnx.srv.spool.open(opts.Channel)
+	if stored != nil {
+		defer stored.Close()
+	}
+
+	hub.mu.Lock()
+	channel := hub.channel(opts.Channel)
+	stream := channel.stream
+	late := stream != nil && stream.replayable()
+	var replayed [][]byte
+	if opts.Live {
+		if stream != nil {
+			replayed = stream.liveFrames()
+		}
+		if replayed == nil {
+			hub.release(opts.Channel)
+			hub.mu.Unlock()
+			cnx.srv.logf("Stream pull rejected: no live stream on channel %v", channelName)
+			writer.WriteByte(0x05)
+			writer.Flush()
+			return
+		}
+		late = true
+	}
+	if opts.Resume != nil {
+		if stream != nil {
+			replayed = stream.resumedFrames(opts.Resume)
+		}
+		late = replayed != nil
+		if !late {
+			hub.release(opts.Channel)
+			hub.mu.Unlock()
+			cnx.resumeStoredStream(stored, opts.Resume, channelName)
+			return
+		}
+	}
+	if stored != nil && opts.Store && !late && !channel.pushActive && !channel.pushWaiting {
+		hub.release(opts.Channel)
+		hub.mu.Unlock()
+		writer.WriteByte(0x01)
+		if err := cnx.serveStoredStream(stored); err != nil {
+			cnx.srv.logf("Stored stream on channel %v: %v", channelName, err)
+		}
+		return
+	}
+	if channel.pushActive && !late {
+		hub.mu.Unlock()
+		cnx.srv.logf("Stream pull rejected: stream already active on channel %v", channelName)
+		if stream != nil && stream.replay {
+			writer.WriteByte(0x03)
+		} else {
+			writer.WriteByte(0x00)
+		}
+		writer.Flush()
+		return
+	}
+	if uint(len(channel.pullers)) >= conf.MaxWaitingPullers {
+		hub.mu.Unlock()
+		cnx.srv.logf("Stream pull rejected: too many waiting pullers on channel %v", channelName)
+		writer.WriteByte(0x02)
+		writer.Flush()
+		return
+	}
+	sub := newSubscriber(cnx.conn.RemoteAddr(), !late, &cnx.srv.spillTotal)
+	id := hub.nextID
+	hub.nextID++
+	channel.pullers[id] = sub
+	waitCh := channel.waitCh
+	close(channel.joinedCh)
+	channel.joinedCh = make(chan struct{})
+	if late {
+		if replayed == nil {
+			replayed = slices.Clone(stream.frames)
+		}
+		if stream.ended {
+			sub.close()
+		} else {
+			stream.receivers[id] = sub
+		}
+	}
+	hub.mu.Unlock()
+
+	defer func() {
+		hub.mu.Lock()
+		delete(channel.pullers, id)
+		hub.release(opts.Channel)
+		hub.mu.Unlock()
+		sub.release()
+	}()
+
+	writer.WriteByte(0x01)
+	if err := writer.Flush(); err != nil {
+		cnx.srv.logf("Puller %v: failed to send accept status: %v", id, err)
+		return
+	}
+	if opts.Live {
+		go cnx.forwardLiveInput(stream, sub)
+	}
+
+	if !late {
+		waitTimeout := conf.TTL
+		if waitTimeout < time.Hour {
+			waitTimeout = time.Hour
+		}
+		cnx.conn.SetDeadline(time.Now().Add(waitTimeout))
+
+		select {
+		case <-waitCh:
+		case <-sub.done:
+			return
+		case <-time.After(waitTimeout):
+			cnx.srv.logf("Puller %v: wait timeout expired", id)
+			return
+		}
+	}
+
+	endSent := false
+	writeFrame := func(frame []byte) error {
+		endSent = isEndFrame(frame)
+		cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+		if _, err := writer.Write(frame); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		sub.delivered.Add(uint64(len(frame)))
+		return nil
+	}
+	for _, frame := range replayed {
+		if err := writeFrame(frame); err != nil {
+			cnx.srv.logf("Puller %v write error: %v", id, err)
+			return
+		}
+	}
+	if opts.Live {
+		if err := stream.forward(nil); err != nil {
+			cnx.srv.logf("Puller %v: unable to notify the pusher: %v", id, err)
+		}
+	}
+	buf := make([]byte, 4+protocol.MaxChunk+16)
+	for {
+		frame, err := sub.next(buf)
+		if err == io.EOF {
+			if !endSent || opts.Live || cnx.clientVersion < 8 {
+				return
+			}
+			if !sub.ackRequested() {
+				writer.WriteByte(0x00)
+				writer.Flush()
+				return
+			}
+			writer.WriteByte(0x01)
+			if err := writer.Flush(); err != nil {
+				cnx.srv.logf("Puller %v write error: %v", id, err)
+				return
+			}
+			cnx.receiveStreamAck(sub)
+			return
+		} else if err == errPullerDropped {
+			cnx.srv.logf("Puller %v: %v", id, err)
+			binary.Write(writer, binary.LittleEndian, protocol.StreamDroppedMarker)
+			writer.Flush()
+			return
+		} else if err != nil {
+			cnx.srv.logf("Puller %v: %v", id, err)
+			return
+		}
+		if err := writeFrame(frame); err != nil {
+			cnx.srv.logf("Puller %v write error: %v", id, err)
+			return
+		}
+	}
+}
+
+// isEndFrame - Whether a frame is the end frame of a stream: a zero length
+// followed by the signature. The header is shorter, and data frames start
+// with a nonzero length.
+func isEndFrame(frame []byte) bool {
+	return len(frame) == 4+64 && binary.LittleEndian.Uint32(frame) == 0
+}
+
+// receiveStreamAck - Reads the acknowledgement sent by a puller after the end
+// frame, and hands it over to the pusher
+func (cnx *connection) receiveStreamAck(sub *subscriber) {
+	reader := cnx.reader
+	cnx.conn.SetDeadline(time.Now().Add(cnx.conf.Timeout))
+	prefix, err := reader.Peek(2)
+	if err != nil {
+		return
+	}
+	ack := make([]byte, 2+int(prefix[1])+32)
+	if _, err := io.ReadFull(reader, ack); err != nil {
+		return
+	}
+	sub.ack <- ack
+}
+
+// sendStreamAcks - Waits for the pullers that received a stream to
+// acknowledge it, and sends their acknowledgements to the pusher
+func (cnx *connection) sendStreamAcks(receivers map[uint64]*subscriber) error {
+	writer := cnx.writer
+	binary.Write(writer, binary.LittleEndian, uint32(len(receivers)))
+	for _, id := range slices.Sorted(maps.Keys(receivers)) {
+		ack := receivers[id].waitAck()
+		cnx.conn.SetDeadline(time.Now().Add(cnx.conf.DataTimeout))
+		binary.Write(writer, binary.LittleEndian, uint16(len(ack)))
+		writer.Write(ack)
+	}
+	return writer.Flush()
+}
+
+// forwardLiveInput - Forwards what a puller of a live stream sends to the
+// pusher, until the puller leaves
+func (cnx *connection) forwardLiveInput(stream *relayedStream, sub *subscriber) {
+	defer sub.close()
+	reader := cnx.reader
+	for {
+		var frameLen uint32
+		if err := binary.Read(reader, binary.LittleEndian, &frameLen); err != nil {
+			return
+		}
+		if frameLen == 0 || frameLen > protocol.MaxLiveInputLen {
+			return
+		}
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return
+		}
+		if err := stream.forward(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (cnx *connection) pushStreamOperation(h1 []byte) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	opts := cnx.readStreamRequest(h1, byte('P'))
+	if opts == nil {
+		return
+	}
+	channelName := protocol.ChannelLabel(opts.Channel)
+	hub := &cnx.srv.streams
+
+	writeStatus := func(status byte, pullersCount int) error {
+		writer.WriteByte(status)
+		if cnx.clientVersion >= 8 {
+			binary.Write(writer, binary.LittleEndian, uint32(pullersCount))
+		}
+		return writer.Flush()
+	}
+
+	var spool *spoolWriter
+	if opts.Store {
+		var err error
+		if !cnx.srv.spool.enabled() {
+			err = errors.New("no SpoolDir configured")
+		} else {
+			spool, err = cnx.srv.spool.create(opts.Channel)
+		}
+		if err != nil {
+			cnx.srv.logf("Stream push rejected: unable to store the stream: %v", err)
+			writeStatus(0x04, 0)
+			return
+		}
+		defer spool.discard()
+	}
+
+	hub.mu.Lock()
+	channel := hub.channel(opts.Channel)
+	if channel.pushActive || channel.pushWaiting {
+		hub.mu.Unlock()
+		cnx.srv.logf("Stream push rejected: another push already active on channel %v", channelName)
+		writeStatus(0x02, 0)
+		return
+	}
+	if opts.Replay > 0 && hub.replayBytes+conf.MaxReplayBytes > conf.MaxReplayMemory {
+		hub.release(opts.Channel)
+		hub.mu.Unlock()
+		cnx.srv.logf("Stream push rejected: %v bytes are already kept for replay", hub.replayBytes)
+		writeStatus(0x03, 0)
+		return
+	}
+
+	if opts.WaitPullers > 0 {
+		channel.pushWaiting = true
+		waitTimeout := opts.WaitTimeout
+		timer := time.NewTimer(waitTimeout)
+		cnx.conn.SetDeadline(time.Now().Add(waitTimeout + conf.Timeout))
+		gone := make(chan struct{})
+		go func() {
+			reader.Peek(1)
+			close(gone)
+		}()
+		pusherLeft := false
+	wait:
+		for uint32(len(channel.waitingPullers())) < opts.WaitPullers {
+			joinedCh := channel.joinedCh
+			hub.mu.Unlock()
+			select {
+			case <-joinedCh:
+				hub.mu.Lock()
+			case <-gone:
+				hub.mu.Lock()
+				pusherLeft = true
+				break wait
+			case <-timer.C:
+				hub.mu.Lock()
+				break wait
+			}
+		}
+		timer.Stop()
+		if !pusherLeft {
+			hub.mu.Unlock()
+			cnx.conn.SetReadDeadline(time.Now())
+			<-gone
+			cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+			hub.mu.Lock()
+		}
+		channel.pushWaiting = false
+		if pusherLeft {
+			hub.release(opts.Channel)
+			hub.mu.Unlock()
+			cnx.srv.logf("Stream push on channel %v: the pusher left while waiting for pullers", channelName)
+			return
+		}
+	}
+
+	snapshot := channel.waitingPullers()
+	if opts.Live {
+		snapshot = make(map[uint64]*subscriber)
+	}
+
+	if (len(snapshot) == 0 && opts.Replay == 0 && !opts.Store && !opts.Live) || uint32(len(snapshot)) < opts.WaitPullers {
+		hub.release(opts.Channel)
+		hub.mu.Unlock()
+		cnx.srv.logf("Stream push rejected: %v pullers waiting on channel %v", len(snapshot), channelName)
+		writeStatus(0x00, len(snapshot))
+		return
+	}
+	for _, sub := range snapshot {
+		sub.waiting = false
+	}
+	stream := &relayedStream{
+		receivers: snapshot,
+		replay:    opts.Replay > 0,
+		expiresAt: time.Now().Add(opts.Replay),
+		live:      opts.Live,
+	}
+	channel.pushActive = true
+	channel.pushConn = cnx.conn
+	channel.stream = stream
+
+	oldWaitCh := channel.waitCh
+	channel.waitCh = make(chan struct{})
+	hub.mu.Unlock()
+
+	close(oldWaitCh)
+
+	completed := false
+	defer func() {
+		hub.mu.Lock()
+		for _, sub := range stream.receivers {
+			sub.close()
+		}
+		stream.receivers = nil
+		stream.ended, stream.failed = true, !completed
+		channel.pushActive = false
+		channel.pushConn = nil
+		if stream.replayable() {
+			time.AfterFunc(time.Until(stream.expiresAt), func() {
+				hub.mu.Lock()
+				hub.dropReplay(stream)
+				if channel.stream == stream {
+					channel.stream = nil
+					hub.release(opts.Channel)
+				}
+				hub.mu.Unlock()
+			})
+		} else {
+			hub.dropReplay(stream)
+			channel.stream = nil
+		}
+		hub.release(opts.Channel)
+		hub.mu.Unlock()
+	}()
+
+	if err := writeStatus(0x01, len(snapshot)); err != nil {
+		cnx.srv.log("Stream push: failed to send accept status: ", err)
+		return
+	}
+	hub.mu.Lock()
+	stream.input = writer
+	hub.mu.Unlock()
+
+	relay := func(frame []byte) bool {
+		if spool != nil {
+			if _, err := spool.Write(frame); err != nil {
+				cnx.srv.logf("Stream push: unable to store the stream: %v", err)
+				return false
+			}
+		}
+		hub.mu.Lock()
+		if stream.header == nil {
+			stream.header = frame
+		} else {
+			stream.chunks++
+		}
+		if stream.replay && !stream.overflowed && !hub.keepForReplay(conf, stream, frame) {
+			cnx.srv.logf("Stream push: replay buffer of channel %v is full - Late pullers will be rejected", channelName)
+		}
+		receivers := maps.Clone(stream.receivers)
+		hub.mu.Unlock()
+		for id, sub := range receivers {
+			if !sub.send(conf, frame) {
+				hub.mu.Lock()
+				delete(stream.receivers, id)
+				hub.mu.Unlock()
+			}
+		}
+		return true
+	}
+
+	header := make([]byte, 32)
+	cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		cnx.srv.log("Stream push: failed to read header: ", err)
+		return
+	}
+	if !relay(header) {
+		return
+	}
+
+	var streamStart time.Time
+	if conf.MaxStreamDuration > 0 {
+		streamStart = time.Now()
+	}
+	var totalBytes uint64
+
+	for {
+		var chunkLen uint32
+		cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+		if err := binary.Read(reader, binary.LittleEndian, &chunkLen); err != nil {
+			cnx.srv.log("Stream push: failed to read chunk length: ", err)
+			return
+		}
+
+		lenBuf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lenBuf, chunkLen)
+
+		if chunkLen == 0 {
+			sig := make([]byte, 64)
+			if _, err := io.ReadFull(reader, sig); err != nil {
+				cnx.srv.log("Stream push: failed to read signature: ", err)
+				return
+			}
+			endFrame := append(lenBuf, sig...)
+			storeStatus := byte(0x01)
+			if spool != nil {
+				_, err := spool.Write(endFrame)
+				if err == nil {
+					err = spool.commit()
+				}
+				if err != nil {
+					cnx.srv.logf("Stream push: unable to store the stream: %v", err)
+					storeStatus = 0x00
+				}
+				spool = nil
+			}
+			relay(endFrame)
+			completed = true
+			if opts.Store {
+				cnx.conn.SetDeadline(time.Now().Add(conf.Timeout))
+				writer.WriteByte(storeStatus)
+				if err := writer.Flush(); err != nil {
+					cnx.srv.log("Stream push: failed to send the store status: ", err)
+					return
+				}
+			}
+			if opts.Ack {
+				hub.mu.Lock()
+				receivers := maps.Clone(stream.receivers)
+				hub.mu.Unlock()
+				for _, sub := range receivers {
+					sub.requestAck()
+				}
+				if err := cnx.sendStreamAcks(receivers); err != nil {
+					cnx.srv.log("Stream push: failed to send acknowledgements: ", err)
+				}
+			}
+			return
+		}
+
+		if chunkLen > protocol.MaxChunk {
+			cnx.srv.logf("Stream push: chunk too large (%v > %v)", chunkLen, protocol.MaxChunk)
+			return
+		}
+
+		sealedLen := uint32(chunkLen) + 16
+		totalBytes += uint64(sealedLen)
+		if conf.MaxStreamBytes > 0 && totalBytes > conf.MaxStreamBytes {
+			cnx.srv.log("Stream push: exceeded MaxStreamBytes")
+			return
+		}
+		if conf.MaxStreamDuration > 0 && time.Since(streamStart) > conf.MaxStreamDuration {
+			cnx.srv.log("Stream push: exceeded MaxStreamDuration")
+			return
+		}
+
+		sealed := make([]byte, sealedLen)
+		cnx.conn.SetDeadline(time.Now().Add(conf.DataTimeout))
+		if _, err := io.ReadFull(reader, sealed); err != nil {
+			cnx.srv.log("Stream push: failed to read chunk data: ", err)
+			return
+		}
+
+		frame := make([]byte, 4+len(sealed))
+		copy(frame, lenBuf)
+		copy(frame[4:], sealed)
+		if !relay(frame) {
+			return
+		}
+	}
+}
+
+// PullerInfo - A client receiving or waiting to receive a stream. Queued is
+// the number of bytes it hasn't received yet, and Spilled the number of bytes
+// that had to be queued to disk.
+type PullerInfo struct {
+	ID         uint64
+	Channel    string
+	RemoteAddr net.Addr
+	Since      time.Time
+	Delivered  uint64
+	Queued     uint64
+	Spilled    uint64
+}
+
+// Pullers - Returns the clients receiving or waiting to receive a stream, by
+// ID
+func (srv *Server) Pullers() []PullerInfo {
+	hub := &srv.streams
+	hub.mu.Lock()
+	var pullers []PullerInfo
+	subs := make(map[uint64]*subscriber)
+	for channelID, channel := range hub.channels {
+		for id, sub := range channel.pullers {
+			pullers = append(pullers, PullerInfo{
+				ID:         id,
+				Channel:    protocol.ChannelLabel([]byte(channelID)),
+				RemoteAddr: sub.remoteAddr,
+				Since:      sub.since,
+			})
+			subs[id] = sub
+		}
+	}
+	hub.mu.Unlock()
+	for i := range pullers {
+		sub := subs[pullers[i].ID]
+		pullers[i].Delivered = sub.delivered.Load()
+		pullers[i].Queued, pullers[i].Spilled = sub.lag()
+	}
+	slices.SortFunc(pullers, func(a, b PullerInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return pullers
+}
+
+// PushInfo - A client pushing a stream
+type PushInfo struct {
+	Channel    string
+	RemoteAddr net.Addr
+}
+
+// AbortPushes - Disconnects the clients pushing streams, and returns them
+func (srv *Server) AbortPushes() []PushInfo {
+	hub := &srv.streams
+	hub.mu.Lock()
+	var pushConns []net.Conn
+	var pushes []PushInfo
+	for channelID, channel := range hub.channels {
+		if channel.pushConn != nil {
+			pushConns = append(pushConns, channel.pushConn)
+			pushes = append(pushes, PushInfo{
+				Channel:    protocol.ChannelLabel([]byte(channelID)),
+				RemoteAddr: channel.pushConn.RemoteAddr(),
+			})
+		}
+	}
+	hub.mu.Unlock()
+	for _, pushConn := range pushConns {
+		pushConn.Close()
+	}
+	return pushes
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+	"github.com/jedisct1/piknik/internal/testutil"
+)
+
+// blockedWriter - A writer whose first write waits until unblocked is closed
+type blockedWriter struct {
+	bytes.Buffer
+	unblocked chan struct{}
+}
+
+func (bw *blockedWriter) Write(p []byte) (int, error) {
+	<-bw.unblocked
+	return bw.Buffer.Write(p)
+}
+
+func TestStreamAckAfterSpill(t *testing.T) {
+	serverConf, clientConf := testConfigs(t)
+	serverConf.SlowPullerPolicy = SlowPullerSpill
+	serverConf.SpoolDir = t.TempDir()
+	srv, addr := startTestServer(t, serverConf)
+	clientConf.Connect = addr
+	ctx := context.Background()
+	content := make([]byte, 32*1024*1024)
+	rand.Read(content)
+
+	output := &blockedWriter{unblocked: make(chan struct{})}
+	pulled := make(chan error, 1)
+	go func() {
+		pulled <- testutil.NewClient(t, clientConf).Pull(ctx, output, &client.PullOptions{CID: "spill"})
+	}()
+	go func() {
+		defer close(output.unblocked)
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+			if pullers := srv.Pullers(); len(pullers) == 1 && pullers[0].Spilled > 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("nothing was spilled")
+	}()
+
+	// Chunks are half the size of the buffer frames are read back into
+	input := iotest.HalfReader(bytes.NewReader(content))
+	result, err := testutil.NewClient(t, clientConf).Push(ctx, input, &client.PushOptions{
+		CID:         "spill",
+		WaitPullers: 1,
+		WaitTimeout: 5 * time.Second,
+		Ack:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Acks) != 1 || result.Acks[0].Status != client.AckVerified {
+		t.Fatalf("Push() = %+v, want the puller to acknowledge the stream", result)
+	}
+	if err := <-pulled; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), content) {
+		t.Fatal("pulled content differs from the pushed content")
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+)
+
+// A tunnel is a full-duplex pipe between two clients that meet on the server
+// using the same channel. Once the server has paired them, it relays whatever
+// each of them sends to the other one. Each peer starts with a header similar
+// to a stream header, and then sends frames sealed like stream chunks, using a
+// key specific to its direction. A frame with an empty payload ends a
+// direction. -forward and -expose open a tunnel for every TCP connection.
+
+// tunnelEnd - A client waiting for a peer. The client doesn't send anything
+// until it has been paired, so the connection is watched in order to notice
+// clients that leave in the meantime.
+type tunnelEnd struct {
+	cnx      *connection
+	role     byte
+	paired   chan struct{}
+	gone     chan struct{}
+	finished chan struct{}
+}
+
+// tunnelHub - Clients waiting for a peer, by channel
+type tunnelHub struct {
+	sync.Mutex
+
+	waiting map[string][]*tunnelEnd
+}
+
+// peerRole - Role of the clients that a client can be paired with
+func peerRole(role byte) byte {
+	switch role {
+	case protocol.TunnelRoleConnect:
+		return protocol.TunnelRoleAccept
+	case protocol.TunnelRoleAccept:
+		return protocol.TunnelRoleConnect
+	}
+	return protocol.TunnelRolePeer
+}
+
+// pair - Returns a waiting client that the new one can be paired with, or
+// registers the new one as waiting if there is none
+func (hub *tunnelHub) pair(channelID []byte, end *tunnelEnd) *tunnelEnd {
+	hub.Lock()
+	defer hub.Unlock()
+	waiting := hub.waiting[string(channelID)]
+	for i, peer := range waiting {
+		if peer.role == peerRole(end.role) {
+			hub.update(channelID, slices.Delete(waiting, i, i+1))
+			return peer
+		}
+	}
+	hub.update(channelID, append(waiting, end))
+	return nil
+}
+
+// cancel - Stops waiting for a peer. Returns false if the client has already
+// been paired.
+func (hub *tunnelHub) cancel(channelID []byte, end *tunnelEnd) bool {
+	hub.Lock()
+	defer hub.Unlock()
+	waiting := hub.waiting[string(channelID)]
+	i := slices.Index(waiting, end)
+	if i < 0 {
+		return false
+	}
+	hub.update(channelID, slices.Delete(waiting, i, i+1))
+	return true
+}
+
+// update - Replaces the clients waiting on a channel. The hub must be locked.
+func (hub *tunnelHub) update(channelID []byte, waiting []*tunnelEnd) {
+	if len(waiting) == 0 {
+		delete(hub.waiting, string(channelID))
+	} else {
+		hub.waiting[string(channelID)] = waiting
+	}
+}
+
+func (cnx *connection) tunnelOperation(h1 []byte) {
+	conf := cnx.conf
+	opts := cnx.readStreamRequest(h1, byte('T'))
+	if opts == nil {
+		return
+	}
+	channelName := protocol.ChannelLabel(opts.Channel)
+	end := &tunnelEnd{
+		cnx:      cnx,
+		role:     opts.TunnelRole,
+		paired:   make(chan struct{}),
+		gone:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	peer := cnx.srv.tunnels.pair(opts.Channel, end)
+	if peer == nil {
+		waitTimeout := conf.TTL
+		if waitTimeout < time.Hour {
+			waitTimeout = time.Hour
+		}
+		if end.role == protocol.TunnelRoleConnect {
+			waitTimeout = conf.Timeout
+		}
+		cnx.conn.SetDeadline(time.Now().Add(waitTimeout))
+		go func() {
+			cnx.reader.Peek(1)
+			close(end.gone)
+		}()
+		select {
+		case <-end.paired:
+		case <-end.gone:
+			if cnx.srv.tunnels.cancel(opts.Channel, end) {
+				return
+			}
+			<-end.paired
+		case <-time.After(waitTimeout):
+			if cnx.srv.tunnels.cancel(opts.Channel, end) {
+				cnx.srv.logf("Tunnel on channel %v: no peer showed up within %v", channelName, waitTimeout)
+				return
+			}
+			<-end.paired
+		}
+		<-end.finished
+		return
+	}
+	close(peer.paired)
+	defer close(peer.finished)
+	peer.cnx.conn.SetReadDeadline(time.Now())
+	<-peer.gone
+
+	for _, c := range []*connection{peer.cnx, cnx} {
+		c.conn.SetDeadline(time.Time{})
+		c.writer.WriteByte(0x01)
+		if err := c.writer.Flush(); err != nil {
+			cnx.srv.logf("Tunnel on channel %v: failed to send accept status: %v", channelName, err)
+			return
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pipeTunnel(conf, peer.cnx, cnx)
+	}()
+	pipeTunnel(conf, cnx, peer.cnx)
+	wg.Wait()
+}
+
+// pipeTunnel - Relays what a client sends to its peer, until it stops
+// sending. Data goes through the buffered writer of the peer, so that the
+// bandwidth limits apply.
+func pipeTunnel(conf Config, from *connection, to *connection) {
+	buf := make([]byte, 4+protocol.MaxChunk+16)
+	for {
+		from.conn.SetReadDeadline(time.Now().Add(conf.DataTimeout))
+		n, err := from.reader.Read(buf)
+		if n > 0 {
+			to.conn.SetWriteDeadline(time.Now().Add(conf.DataTimeout))
+			to.writer.Write(buf[:n])
+			if err := to.writer.Flush(); err != nil {
+				from.conn.Close()
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if tcpConn, ok := to.conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	} else {
+		to.conn.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+	"github.com/jedisct1/piknik/internal/testutil"
+)
+
+func TestTunnelRateLimit(t *testing.T) {
+	const rate = 4 * 1024 * 1024
+	serverConf, clientConf := testConfigs(t)
+	serverConf.MaxRate = rate
+	_, clientConf.Connect = startTestServer(t, serverConf)
+	ctx := context.Background()
+	content := make([]byte, rate/2)
+	rand.Read(content)
+
+	opened := make(chan *client.Tunnel, 2)
+	for range 2 {
+		go func() {
+			tunnel, err := testutil.NewClient(t, clientConf).OpenTunnel(ctx, "tunnel", client.TunnelPeer)
+			if err != nil {
+				t.Error(err)
+			}
+			opened <- tunnel
+		}()
+	}
+	sender, receiver := <-opened, <-opened
+	if sender == nil || receiver == nil {
+		t.FailNow()
+	}
+	defer sender.Close()
+	defer receiver.Close()
+
+	// What the server receives and what it relays both count against
+	// MaxRate, so relaying the content takes about twice as long as it would
+	// take to only receive it
+	start := time.Now()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sender.Run(bytes.NewReader(content), &bytes.Buffer{})
+	}()
+	var received bytes.Buffer
+	if err := receiver.Run(bytes.NewReader(nil), &received); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received.Bytes(), content) {
+		t.Fatal("received content differs from the sent content")
+	}
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Fatalf("relayed %v bytes in %v, faster than MaxRate allows", len(content), elapsed)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/piknik/internal/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Resumable uploads store content like the copy operation, but the server
+// keeps what it has received so far if the connection is lost. The client can
+// then reconnect, get the number of bytes the server already has, and send
+// the rest. The content is only published once it has been fully received and
+// its signature has been verified. Pending uploads only use memory for what
+// has been received, and are forgotten if they are not resumed within
+// uploadResumeTimeout. New uploads are rejected if the announced lengths of
+// the pending ones would exceed maxPendingUploadsLen, unless there are none.
+
+const (
+	maxPendingUploads    = 16
+	maxPendingUploadsLen = uint64(2 * 1024 * 1024 * 1024)
+	maxUploadLen         = uint64(1024 * 1024 * 1024) // when MaxLen is unlimited
+	uploadResumeTimeout  = time.Minute
+)
+
+// pendingUpload - Content being uploaded. The connection receiving it holds
+// the lock.
+type pendingUpload struct {
+	sync.Mutex
+
+	id         []byte
+	ts         []byte
+	signature  []byte
+	contentLen uint64
+	data       []byte
+	conn       net.Conn
+	updatedAt  time.Time
+}
+
+// pendingUploads - Uploads that haven't been completed yet, and the sum of
+// their lengths
+type pendingUploads struct {
+	sync.Mutex
+
+	uploads  map[string]*pendingUpload
+	totalLen uint64
+}
+
+// acquire - Starts a new upload identified by newID if the upload ID is all
+// zeros, or returns the upload to resume, taking it over from a previous
+// connection that may not have noticed it was lost yet. Returns nil and a
+// status code if the upload can't be accepted.
+func (uploads *pendingUploads) acquire(uploadID []byte, newID []byte, contentLen uint64, ts []byte,
+	signature []byte, conn net.Conn,
+) (*pendingUpload, byte) {
+	uploads.Lock()
+	var upload *pendingUpload
+	if subtle.ConstantTimeCompare(uploadID, make([]byte, protocol.UploadIDLen)) == 1 {
+		if len(uploads.uploads) >= maxPendingUploads ||
+			(uploads.totalLen > 0 && uploads.totalLen+contentLen > maxPendingUploadsLen) {
+			uploads.Unlock()
+			return nil, 0x02
+		}
+		upload = &pendingUpload{
+			id:         newID,
+			ts:         bytes.Clone(ts),
+			signature:  bytes.Clone(signature),
+			contentLen: contentLen,
+		}
+		uploads.uploads[string(newID)] = upload
+		uploads.totalLen += contentLen
+	} else {
+		upload = uploads.uploads[string(uploadID)]
+		if upload == nil || upload.contentLen != contentLen ||
+			!bytes.Equal(upload.ts, ts) || !bytes.Equal(upload.signature, signature) {
+			uploads.Unlock()
+			return nil, 0x00
+		}
+	}
+	previous := upload.conn
+	upload.conn = conn
+	uploads.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	upload.Lock()
+	return upload, 0x01
+}
+
+// release - Called when the connection receiving an upload is gone. An
+// incomplete upload is forgotten if it isn't resumed in time.
+func (uploads *pendingUploads) release(timeout time.Duration, upload *pendingUpload, conn net.Conn) {
+	uploads.Lock()
+	if upload.conn == conn {
+		upload.conn = nil
+	}
+	upload.updatedAt = time.Now()
+	uploads.Unlock()
+	upload.Unlock()
+	time.AfterFunc(timeout, func() {
+		uploads.Lock()
+		if upload.conn == nil && time.Since(upload.updatedAt) >= timeout {
+			uploads.forget(upload)
+		}
+		uploads.Unlock()
+	})
+}
+
+// remove - Forgets an upload, once it has been completed or rejected
+func (uploads *pendingUploads) remove(upload *pendingUpload) {
+	uploads.Lock()
+	uploads.forget(upload)
+	uploads.Unlock()
+}
+
+// forget - Removes an upload if it is still pending. The uploads must be
+// locked.
+func (uploads *pendingUploads) forget(upload *pendingUpload) {
+	if uploads.uploads[string(upload.id)] == upload {
+		delete(uploads.uploads, string(upload.id))
+		uploads.totalLen -= upload.contentLen
+	}
+}
+
+func (cnx *connection) uploadOperation(h1 []byte) {
+	conf, reader, writer := cnx.conf, cnx.reader, cnx.writer
+	rbuf := make([]byte, 32+protocol.UploadIDLen+8+8+64)
+	if _, err := io.ReadFull(reader, rbuf); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	h2 := rbuf[0:32]
+	uploadID := rbuf[32:48]
+	contentLenBuf := rbuf[48:56]
+	ts := rbuf[56:64]
+	signature := rbuf[64:128]
+	opcode := byte('U')
+
+	wh2 := protocol.Auth2Upload(conf.Psk, cnx.clientVersion, h1, opcode, uploadID, contentLenBuf, ts, signature)
+	if subtle.ConstantTimeCompare(wh2, h2) != 1 {
+		return
+	}
+	writeStatus := func(status byte, uploadID []byte, received uint64) error {
+		writer.WriteByte(status)
+		writer.Write(uploadID)
+		binary.Write(writer, binary.LittleEndian, received)
+		return writer.Flush()
+	}
+	ciphertextWithEncryptSkIDAndNonceLen := binary.LittleEndian.Uint64(contentLenBuf)
+	if ciphertextWithEncryptSkIDAndNonceLen < 8+24 {
+		cnx.srv.logf("Short encrypted message (only %v bytes)\n", ciphertextWithEncryptSkIDAndNonceLen)
+		return
+	}
+	maxLen := conf.MaxLen
+	if maxLen == 0 {
+		maxLen = maxUploadLen
+	}
+	if ciphertextWithEncryptSkIDAndNonceLen > maxLen {
+		cnx.srv.logf("%v bytes requested to be stored, but limit set to %v bytes (%v Mb)\n",
+			ciphertextWithEncryptSkIDAndNonceLen, maxLen, maxLen/(1024*1024))
+		writeStatus(0x03, uploadID, 0)
+		return
+	}
+	newID := make([]byte, protocol.UploadIDLen)
+	if _, err := rand.Read(newID); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	upload, status := cnx.srv.uploads.acquire(uploadID, newID, ciphertextWithEncryptSkIDAndNonceLen, ts, signature,
+		cnx.conn)
+	if upload == nil {
+		if status == 0x02 {
+			cnx.srv.log("Upload rejected: too many pending uploads, or too much pending content")
+		} else {
+			cnx.srv.log("Upload rejected: unknown or expired upload")
+		}
+		writeStatus(status, uploadID, 0)
+		return
+	}
+	resumeTimeout := min(conf.DataTimeout, uploadResumeTimeout)
+	defer cnx.srv.uploads.release(resumeTimeout, upload, cnx.conn)
+
+	if err := writeStatus(0x01, upload.id, uint64(len(upload.data))); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+	buf := make([]byte, protocol.MaxChunk)
+	for remaining := upload.contentLen - uint64(len(upload.data)); remaining > 0; {
+		cnx.conn.SetDeadline(time.Now().Add(resumeTimeout))
+		n, err := reader.Read(buf[:min(uint64(len(buf)), remaining)])
+		upload.data = append(upload.data, buf[:n]...)
+		remaining -= uint64(n)
+		if err != nil {
+			cnx.srv.logf("Upload interrupted after %v of %v bytes: %v", len(upload.data), upload.contentLen, err)
+			return
+		}
+	}
+	cnx.srv.uploads.remove(upload)
+	if !ed25519.Verify(conf.SignPk, upload.data, upload.signature) {
+		return
+	}
+	h3 := protocol.Auth3Store(conf.Psk, h2)
+
+	if err := cnx.srv.clipboard.update(upload.ts, upload.signature, upload.data); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+
+	writer.Write(h3)
+	if err := writer.Flush(); err != nil {
+		cnx.srv.log(err)
+		return
+	}
+}
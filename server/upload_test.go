@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+	"github.com/jedisct1/piknik/internal/protocol"
+	"github.com/jedisct1/piknik/internal/testutil"
+)
+
+// cuttingProxy - Relays connections to addr, but closes the first one once
+// cut bytes have been sent by the client
+func cuttingProxy(t *testing.T, addr string, cut int64) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			var fromClient io.Reader = conn
+			if first {
+				fromClient = io.LimitReader(conn, cut)
+			}
+			var once sync.Once
+			closeBoth := func() {
+				conn.Close()
+				upstream.Close()
+			}
+			go func() {
+				io.Copy(upstream, fromClient)
+				once.Do(closeBoth)
+			}()
+			go func() {
+				io.Copy(conn, upstream)
+				once.Do(closeBoth)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestUploadResume(t *testing.T) {
+	serverConf, clientConf := testConfigs(t)
+	srv, addr := startTestServer(t, serverConf)
+	clientConf.Connect = cuttingProxy(t, addr, 100*1024)
+	var clientLog bytes.Buffer
+	clientConf.ErrorLog = log.New(&clientLog, "", 0)
+	c := testutil.NewClient(t, clientConf)
+	content := make([]byte, 1024*1024)
+	rand.Read(content)
+	if err := c.Copy(context.Background(), bytes.NewReader(content), &client.CopyOptions{Retries: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(clientLog.String(), "Reconnecting") {
+		t.Fatal("the upload wasn't interrupted")
+	}
+	stored, err := srv.Clipboard()
+	if err != nil || stored == nil {
+		t.Fatalf("Clipboard() = %v, %v", stored, err)
+	}
+	clientConf.Connect = addr
+	c = testutil.NewClient(t, clientConf)
+	var pasted bytes.Buffer
+	if err := c.Paste(context.Background(), &pasted, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pasted.Bytes(), content) {
+		t.Fatal("pasted content differs from the copied content")
+	}
+	srv.uploads.Lock()
+	pending := len(srv.uploads.uploads)
+	srv.uploads.Unlock()
+	if pending != 0 {
+		t.Fatalf("%v uploads still pending", pending)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	serverConf, clientConf := testConfigs(t)
+	serverConf.MaxLen = 1000
+	_, clientConf.Connect = startTestServer(t, serverConf)
+	c := testutil.NewClient(t, clientConf)
+	err := c.Copy(context.Background(), bytes.NewReader(make([]byte, 2000)), &client.CopyOptions{Retries: 1})
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("Copy() = %v, want the content to be rejected", err)
+	}
+}
+
+func TestPendingUploads(t *testing.T) {
+	uploads := pendingUploads{uploads: make(map[string]*pendingUpload)}
+	zeros := make([]byte, protocol.UploadIDLen)
+	id := bytes.Repeat([]byte{1}, protocol.UploadIDLen)
+	ts, signature := bytes.Repeat([]byte{2}, 8), bytes.Repeat([]byte{3}, 64)
+	conn1, peer1 := net.Pipe()
+	defer peer1.Close()
+
+	upload, status := uploads.acquire(zeros, id, 1000, ts, signature, conn1)
+	if upload == nil || status != 0x01 || !bytes.Equal(upload.id, id) {
+		t.Fatalf("acquire() = %v, %v for a new upload", upload, status)
+	}
+	upload.data = append(upload.data, "received so far"...)
+
+	// Resuming takes the upload over from the previous connection, that is
+	// closed, and gets what was received so far
+	conn2, peer2 := net.Pipe()
+	defer peer2.Close()
+	resumed := make(chan *pendingUpload)
+	go func() {
+		upload, _ := uploads.acquire(id, zeros, 1000, ts, signature, conn2)
+		resumed <- upload
+	}()
+	if _, err := peer1.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the previous connection wasn't closed")
+	}
+	uploads.release(time.Hour, upload, conn1)
+	if got := <-resumed; got != upload || string(got.data) != "received so far" {
+		t.Fatalf("acquire() = %v, want the pending upload", got)
+	}
+	if upload.conn != conn2 {
+		t.Fatal("release() of the previous connection dropped the new one")
+	}
+
+	// The length, timestamp and signature must match
+	for _, mismatch := range []struct {
+		contentLen    uint64
+		ts, signature []byte
+	}{
+		{999, ts, signature},
+		{1000, bytes.Repeat([]byte{4}, 8), signature},
+		{1000, ts, bytes.Repeat([]byte{4}, 64)},
+	} {
+		got, status := uploads.acquire(id, zeros, mismatch.contentLen, mismatch.ts, mismatch.signature, nil)
+		if got != nil || status != 0x00 {
+			t.Fatalf("acquire() = %v, %v for a mismatched upload", got, status)
+		}
+	}
+	unknown := bytes.Repeat([]byte{5}, protocol.UploadIDLen)
+	if got, status := uploads.acquire(unknown, zeros, 1000, ts, signature, nil); got != nil || status != 0x00 {
+		t.Fatalf("acquire() = %v, %v for an unknown upload", got, status)
+	}
+
+	// Abandoned uploads are forgotten once the timeout has elapsed
+	uploads.release(50*time.Millisecond, upload, conn2)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		uploads.Lock()
+		pending := len(uploads.uploads)
+		uploads.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the abandoned upload wasn't forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPendingUploadsLimit(t *testing.T) {
+	uploads := pendingUploads{uploads: make(map[string]*pendingUpload)}
+	zeros := make([]byte, protocol.UploadIDLen)
+	for i := 0; i < maxPendingUploads; i++ {
+		id := bytes.Repeat([]byte{byte(i + 1)}, protocol.UploadIDLen)
+		if upload, status := uploads.acquire(zeros, id, 100, nil, nil, nil); upload == nil || status != 0x01 {
+			t.Fatalf("acquire() = %v, %v for upload %v", upload, status, i)
+		}
+	}
+	id := bytes.Repeat([]byte{0xff}, protocol.UploadIDLen)
+	if upload, status := uploads.acquire(zeros, id, 100, nil, nil, nil); upload != nil || status != 0x02 {
+		t.Fatalf("acquire() = %v, %v, want the upload to be rejected", upload, status)
+	}
+}
+
+func TestPendingUploadsTotalLen(t *testing.T) {
+	uploads := pendingUploads{uploads: make(map[string]*pendingUpload)}
+	zeros := make([]byte, protocol.UploadIDLen)
+	id := func(i byte) []byte { return bytes.Repeat([]byte{i}, protocol.UploadIDLen) }
+
+	// A single upload is accepted whatever its length
+	large, status := uploads.acquire(zeros, id(1), maxPendingUploadsLen+1, nil, nil, nil)
+	if large == nil || status != 0x01 {
+		t.Fatalf("acquire() = %v, %v for a single large upload", large, status)
+	}
+	if upload, status := uploads.acquire(zeros, id(2), 1, nil, nil, nil); upload != nil || status != 0x02 {
+		t.Fatalf("acquire() = %v, %v, want the upload to be rejected", upload, status)
+	}
+	uploads.remove(large)
+
+	half, _ := uploads.acquire(zeros, id(3), maxPendingUploadsLen/2, nil, nil, nil)
+	if upload, status := uploads.acquire(zeros, id(4), maxPendingUploadsLen/2, nil, nil, nil); upload == nil || status != 0x01 {
+		t.Fatalf("acquire() = %v, %v for uploads within the limit", upload, status)
+	}
+	if upload, status := uploads.acquire(zeros, id(5), 1, nil, nil, nil); upload != nil || status != 0x02 {
+		t.Fatalf("acquire() = %v, %v, want the upload to be rejected", upload, status)
+	}
+	// Forgetting an upload twice only releases its length once
+	uploads.remove(half)
+	uploads.remove(half)
+	if uploads.totalLen != maxPendingUploadsLen/2 {
+		t.Fatalf("total length = %v, want %v", uploads.totalLen, maxPendingUploadsLen/2)
+	}
+}
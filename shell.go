@@ -0,0 +1,231 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/jedisct1/piknik/client"
+	"github.com/jedisct1/piknik/internal/protocol"
+	"golang.org/x/term"
+)
+
+// A shared shell is a live stream: the output of a shell running in a
+// pseudo-terminal is pushed to clients using -attach, that can join and leave
+// at any time and receive what the shell prints from then on. Every message
+// starts with its type: terminal data, or the size of the terminal. With -rw,
+// what attached clients type is sent back through the server, and written to
+// the shell.
+
+const (
+	shellMsgData       = byte(0x01)
+	shellMsgWindowSize = byte(0x02)
+
+	// shellDetachKey - Ctrl-], detaches from a shared shell
+	shellDetachKey = byte(0x1d)
+)
+
+var errDetached = errors.New("Detached")
+
+func shareShell(stream *client.LiveStream, conf Conf, readWrite bool) error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ptmx.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	stdinFd := int(os.Stdin.Fd())
+	if IsTerminal(stdinFd) {
+		pty.InheritSize(os.Stdin, ptmx)
+		fmt.Fprintf(os.Stderr, "Sharing %v - Exit the shell to stop sharing it\n", shell)
+		if oldState, err := term.MakeRaw(stdinFd); err == nil {
+			defer term.Restore(stdinFd, oldState)
+		}
+	}
+
+	sendMessage := func(msgType byte, payload []byte) error {
+		return stream.Send(append([]byte{msgType}, payload...))
+	}
+	sendWindowSize := func() error {
+		rows, cols, err := pty.Getsize(ptmx)
+		if err != nil || rows == 0 || cols == 0 {
+			return nil
+		}
+		payload := binary.LittleEndian.AppendUint16(nil, uint16(cols))
+		payload = binary.LittleEndian.AppendUint16(payload, uint16(rows))
+		return sendMessage(shellMsgWindowSize, payload)
+	}
+	if err := sendWindowSize(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go io.Copy(ptmx, os.Stdin)
+	go func() {
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		keepAlive := min(time.Minute, conf.DataTimeout/2)
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-winch:
+				if IsTerminal(stdinFd) {
+					pty.InheritSize(os.Stdin, ptmx)
+				}
+				sendWindowSize()
+			case <-ticker.C:
+				sendWindowSize()
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			input, err := stream.ReadInput()
+			if err != nil {
+				return
+			}
+			if len(input) == 0 {
+				sendWindowSize()
+			} else if readWrite && input[0] == shellMsgData {
+				ptmx.Write(input[1:])
+			}
+		}
+	}()
+
+	buf := make([]byte, protocol.MaxChunk-1)
+	for {
+		n, err := ptmx.Read(buf)
+		if n > 0 {
+			os.Stdout.Write(buf[:n])
+			if err := sendMessage(shellMsgData, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return stream.Close()
+}
+
+func attachShell(sub *client.LiveSubscription) error {
+	stdinFd, stdoutFd := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if IsTerminal(stdinFd) {
+		if oldState, err := term.MakeRaw(stdinFd); err == nil {
+			defer term.Restore(stdinFd, oldState)
+		}
+	}
+	var detached atomic.Bool
+	go func() {
+		sendInput := func(data []byte) error {
+			return sub.SendInput(append([]byte{shellMsgData}, data...))
+		}
+		buf := make([]byte, protocol.MaxChunk-1)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if i := bytes.IndexByte(buf[:n], shellDetachKey); i >= 0 {
+				if i > 0 {
+					sendInput(buf[:i])
+				}
+				detached.Store(true)
+				sub.Close()
+				return
+			}
+			if n > 0 {
+				if err := sendInput(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		message, err := sub.Receive()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if detached.Load() {
+				return errDetached
+			}
+			return err
+		}
+		if len(message) == 0 {
+			continue
+		}
+		switch message[0] {
+		case shellMsgData:
+			os.Stdout.Write(message[1:])
+		case shellMsgWindowSize:
+			if len(message) == 5 && IsTerminal(stdoutFd) {
+				cols := binary.LittleEndian.Uint16(message[1:3])
+				rows := binary.LittleEndian.Uint16(message[3:5])
+				fmt.Fprintf(os.Stdout, "\x1b[8;%d;%dt", rows, cols)
+			}
+		}
+	}
+}
+
+// RunShareShell - Run a shell, and stream its terminal to clients using
+// -attach. With readWrite, what they type is sent to the shell.
+func RunShareShell(conf Conf, cid string, readWrite bool) {
+	stream, err := newClient(conf).PushLive(context.Background(), cid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stream.Close()
+	if err := shareShell(stream, conf, readWrite); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// RunAttach - Attach to a shell shared with -share-shell
+func RunAttach(conf Conf, cid string) {
+	sub, err := newClient(conf).PullLive(context.Background(), cid)
+	if errors.Is(err, client.ErrNoLiveStream) {
+		log.Fatal("No shell is being shared on this channel")
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	defer sub.Close()
+	err = attachShell(sub)
+	if err == errDetached {
+		fmt.Fprintln(os.Stderr, "Detached")
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if IsTerminal(int(syscall.Stderr)) {
+		fmt.Fprintln(os.Stderr, "The shared shell has exited")
+	}
+}
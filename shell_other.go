@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "log"
+
+// RunShareShell - Shell sharing requires pseudo-terminals
+func RunShareShell(conf Conf, cid string, readWrite bool) {
+	log.Fatal("Sharing a shell is not supported on this platform")
+}
+
+// RunAttach - Shell sharing requires pseudo-terminals
+func RunAttach(conf Conf, cid string) {
+	log.Fatal("Attaching to a shared shell is not supported on this platform")
+}
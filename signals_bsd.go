@@ -3,15 +3,15 @@
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
+
+	"github.com/jedisct1/piknik/server"
 )
 
-func handleSignals() {
+func handleSignals(srv *server.Server) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINFO)
 	for {
@@ -21,24 +21,11 @@ func handleSignals() {
 		}
 		switch signal {
 		case syscall.SIGINFO:
-			storedContent.RLock()
 			procName := "piknik"
 			if len(os.Args) >= 1 {
 				procName = os.Args[0]
 			}
-			if storedContent.ts == nil {
-				fmt.Printf("%v: the clipboard is empty\n", procName)
-			} else {
-				elapsed := time.Since(time.Unix(int64(binary.LittleEndian.Uint64(storedContent.ts)), 0))
-				if elapsed <= time.Minute {
-					fmt.Printf("%v: the clipboard is not empty (last filled a few moments ago)\n",
-						procName)
-				} else {
-					fmt.Printf("%v: the clipboard is not empty (last filled %v ago)\n",
-						procName, elapsed)
-				}
-			}
-			storedContent.RUnlock()
+			fmt.Printf("%v: %v\n", procName, clipboardStatus(srv))
 		}
 	}
 }
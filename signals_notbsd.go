@@ -2,4 +2,6 @@
 
 package main
 
-func handleSignals() {}
+import "github.com/jedisct1/piknik/server"
+
+func handleSignals(srv *server.Server) {}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+	"github.com/minio/blake2b-simd"
+)
+
+// The sync daemon bridges the local desktop clipboard and the Piknik
+// clipboard. Local changes are detected by polling the local clipboard and are
+// copied, remote changes are received using the watch operation and written to
+// the local clipboard. The hash of the last content seen on either side is
+// remembered, so that content received from the server isn't copied back, and
+// content copied to the server isn't written again when it is received.
+
+const (
+	SyncPollInterval  = time.Second
+	SyncRetryInterval = 5 * time.Second
+)
+
+// ClipboardBackend - Reads and writes the local clipboard
+type ClipboardBackend interface {
+	Read() ([]byte, error)
+	Write(content []byte) error
+}
+
+// commandBackend - Clipboard accessed through external commands
+type commandBackend struct {
+	readCmd  []string
+	writeCmd []string
+}
+
+func (backend *commandBackend) Read() ([]byte, error) {
+	return exec.Command(backend.readCmd[0], backend.readCmd[1:]...).Output()
+}
+
+func (backend *commandBackend) Write(content []byte) error {
+	cmd := exec.Command(backend.writeCmd[0], backend.writeCmd[1:]...)
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(content), os.Stderr
+	return cmd.Run()
+}
+
+// fileBackend - Clipboard stored in a regular file, mainly for testing
+type fileBackend struct {
+	path string
+}
+
+func (backend *fileBackend) Read() ([]byte, error) {
+	return os.ReadFile(backend.path)
+}
+
+func (backend *fileBackend) Write(content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(backend.path), ".piknik-sync-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), backend.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func newClipboardBackend(name string) (ClipboardBackend, error) {
+	if name == "" || name == "auto" {
+		switch {
+		case runtime.GOOS == "darwin":
+			name = "macos"
+		case os.Getenv("WAYLAND_DISPLAY") != "":
+			name = "wayland"
+		case os.Getenv("DISPLAY") != "":
+			name = "x11"
+		default:
+			return nil, fmt.Errorf("Unable to detect the clipboard backend - Use -sync-backend")
+		}
+	}
+	if path, ok := strings.CutPrefix(name, "file:"); ok && path != "" {
+		return &fileBackend{path: path}, nil
+	}
+	var backend *commandBackend
+	switch name {
+	case "wayland":
+		backend = &commandBackend{
+			readCmd:  []string{"wl-paste", "--no-newline"},
+			writeCmd: []string{"wl-copy"},
+		}
+	case "x11":
+		backend = &commandBackend{
+			readCmd:  []string{"xclip", "-selection", "clipboard", "-o"},
+			writeCmd: []string{"xclip", "-selection", "clipboard", "-i"},
+		}
+	case "macos":
+		backend = &commandBackend{
+			readCmd:  []string{"pbpaste"},
+			writeCmd: []string{"pbcopy"},
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported clipboard backend [%v] - Use auto, wayland, x11, macos or file:<path>", name)
+	}
+	for _, command := range []string{backend.readCmd[0], backend.writeCmd[0]} {
+		if _, err := exec.LookPath(command); err != nil {
+			return nil, fmt.Errorf("The [%v] clipboard backend requires the [%v] command", name, command)
+		}
+	}
+	return backend, nil
+}
+
+// clipboardSync - State shared by the local and remote sides of the daemon
+type clipboardSync struct {
+	sync.Mutex
+	client  *client.Client
+	backend ClipboardBackend
+	last    [32]byte
+}
+
+// seen - Records content as the last one seen on either side. Returns the
+// previous hash, and false if the content was already the last one seen.
+func (s *clipboardSync) seen(content []byte) ([32]byte, bool) {
+	h := blake2b.Sum256(content)
+	s.Lock()
+	defer s.Unlock()
+	prev := s.last
+	if h == prev {
+		return prev, false
+	}
+	s.last = h
+	return prev, true
+}
+
+// unsee - Restores the previous hash, unless the other side has seen
+// something else in the meantime
+func (s *clipboardSync) unsee(content []byte, prev [32]byte) {
+	h := blake2b.Sum256(content)
+	s.Lock()
+	if s.last == h {
+		s.last = prev
+	}
+	s.Unlock()
+}
+
+func (s *clipboardSync) copyContent(content []byte) error {
+	return s.client.Copy(context.Background(), bytes.NewReader(content), nil)
+}
+
+func (s *clipboardSync) pollLocal() {
+	for range time.Tick(SyncPollInterval) {
+		content, err := s.backend.Read()
+		if err != nil || len(content) == 0 {
+			continue
+		}
+		if _, changed := s.seen(content); !changed {
+			continue
+		}
+		if err := s.copyContent(content); err != nil {
+			log.Printf("Sync: unable to copy the local clipboard content: %v", err)
+		}
+	}
+}
+
+func (s *clipboardSync) watchRemote() error {
+	return s.client.Watch(context.Background(), func(item *client.Item) error {
+		var content bytes.Buffer
+		if _, err := item.WriteTo(&content); err != nil {
+			log.Printf("Sync: ignoring invalid content: %v", err)
+			return nil
+		}
+		prev, changed := s.seen(content.Bytes())
+		if !changed {
+			return nil
+		}
+		if err := s.backend.Write(content.Bytes()); err != nil {
+			s.unsee(content.Bytes(), prev)
+			log.Printf("Sync: unable to update the local clipboard: %v", err)
+		}
+		return nil
+	})
+}
+
+// RunSync - Keep the local clipboard and the Piknik clipboard in sync
+func RunSync(conf Conf, backendName string) {
+	backend, err := newClipboardBackend(backendName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &clipboardSync{client: newClient(conf), backend: backend}
+	if content, err := backend.Read(); err == nil {
+		s.seen(content)
+	}
+	go func() {
+		for {
+			err := s.watchRemote()
+			log.Printf("Sync: %v - Reconnecting in %v", err, SyncRetryInterval)
+			time.Sleep(SyncRetryInterval)
+		}
+	}()
+	s.pollLocal()
+}
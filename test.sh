@@ -32,6 +32,11 @@ $PIKNIK_C | $PIKNIK_C -copy
 $PIKNIK_C -move > /tmp/pi2
 cmp /tmp/pi /tmp/pi2
 $PIKNIK_C && exit 1
+$PIKNIK_C -copy < /tmp/pi
+$PIKNIK_C -status > /dev/null
+$PIKNIK_C -clear
+$PIKNIK_C -status && exit 1
+$PIKNIK_C && exit 1
 kill $pid
 
 echo
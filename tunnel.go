@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jedisct1/piknik/client"
+)
+
+// RunTunnel - Send the standard input to a peer, and write what it sends to
+// the standard output
+func RunTunnel(conf Conf, cid string) {
+	tunnel, err := newClient(conf).OpenTunnel(context.Background(), cid, client.TunnelPeer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tunnel.Close()
+	if err := tunnel.Run(os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// RunForward - Listen on a local address, and tunnel every connection to the
+// service exposed by a peer
+func RunForward(conf Conf, cid string, listen string) {
+	c := newClient(conf)
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		go func() {
+			defer local.Close()
+			tunnel, err := c.OpenTunnel(context.Background(), cid, client.TunnelConnect)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			defer tunnel.Close()
+			if err := tunnel.Run(local, local); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+}
+
+// RunExpose - Wait for peers using -forward, and connect each of them to a
+// service
+func RunExpose(conf Conf, cid string, target string) {
+	c := newClient(conf)
+	for {
+		tunnel, err := c.OpenTunnel(context.Background(), cid, client.TunnelAccept)
+		if err != nil {
+			log.Printf("%v - Reconnecting in %v", err, client.RetryInterval)
+			time.Sleep(client.RetryInterval)
+			continue
+		}
+		go func() {
+			defer tunnel.Close()
+			local, err := net.DialTimeout("tcp", target, conf.Timeout)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			defer local.Close()
+			if err := tunnel.Run(local, local); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+}